@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"testrtc2/network"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// clientConfig is the -config JSON file,
+// fields of the -profile selected override the top level ones
+type clientConfig struct {
+	Addr        string                      `json:"addr"`
+	Token       string                      `json:"token"`
+	Encoding    string                      `json:"encoding"`
+	ICEServers  []iceServerConfig           `json:"iceServers"`
+	Media       network.MediaDefaults       `json:"media"`
+	DataChannel network.DataChannelDefaults `json:"dataChannel"`
+	Profiles    map[string]json.RawMessage  `json:"profiles"`
+}
+
+type iceServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+}
+
+func loadConfig(path, profile string) (*clientConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &clientConfig{
+		Media:       network.DefaultMedia(),
+		DataChannel: network.DefaultDataChannel(),
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+
+	if profile != "" {
+		raw, ok := config.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("no profile %s in %s", profile, path)
+		}
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(raw, &fields)
+		if err != nil {
+			return nil, fmt.Errorf("parse profile %s: %v", profile, err)
+		}
+		// a list of the profile replaces the one of the file, json would decode
+		// into its elements and keep fields the profile leaves out, e.g. credential
+		if _, ok := fields["iceServers"]; ok {
+			config.ICEServers = nil
+		}
+
+		// only fields set in the profile are overwritten, nested ones too
+		err = json.Unmarshal(raw, config)
+		if err != nil {
+			return nil, fmt.Errorf("parse profile %s: %v", profile, err)
+		}
+	}
+	return config, nil
+}
+
+// peerConfiguration is the default configuration with ICE servers of the file
+func (c *clientConfig) peerConfiguration() (webrtc.Configuration, error) {
+	config := network.DefaultConfiguration()
+	if len(c.ICEServers) == 0 {
+		return config, nil
+	}
+
+	config.ICEServers = nil
+	for _, s := range c.ICEServers {
+		server, err := network.NewICEServer(strings.Join(s.URLs, ","), s.Username, s.Credential)
+		if err != nil {
+			return config, err
+		}
+		config.ICEServers = append(config.ICEServers, server)
+	}
+	return config, nil
+}
+
+func applyConfig(rtc *network.WebRTC, config *clientConfig) error {
+	peerConfig, err := config.peerConfiguration()
+	if err != nil {
+		return err
+	}
+	rtc.SetConfiguration(peerConfig)
+
+	err = rtc.SetMediaDefaults(config.Media)
+	if err != nil {
+		return err
+	}
+	return rtc.SetDataChannelDefaults(config.DataChannel)
+}
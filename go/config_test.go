@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigProfileICEServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"iceServers": [{"urls": ["turn:a"], "username": "u", "credential": "p"}],
+		"profiles": {
+			"stun": {"iceServers": [{"urls": ["stun:b"]}]},
+			"addr": {"addr": "ws://b"}
+		}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		profile string
+		want    []iceServerConfig
+	}{
+		{"", []iceServerConfig{{URLs: []string{"turn:a"}, Username: "u", Credential: "p"}}},
+		{"stun", []iceServerConfig{{URLs: []string{"stun:b"}}}},
+		{"addr", []iceServerConfig{{URLs: []string{"turn:a"}, Username: "u", Credential: "p"}}},
+	}
+	for _, tt := range tests {
+		config, err := loadConfig(path, tt.profile)
+		if err != nil {
+			t.Fatalf("profile %q: %v", tt.profile, err)
+		}
+		if !reflect.DeepEqual(config.ICEServers, tt.want) {
+			t.Errorf("profile %q: iceServers %+v, want %+v", tt.profile, config.ICEServers, tt.want)
+		}
+	}
+}
@@ -13,13 +13,15 @@ void gstreamer_send_start_mainloop(void) {
   g_main_loop_run(gstreamer_send_main_loop);
 }
 
+// stops only the pipeline of data on error or end of stream, the client keeps running
 static gboolean gstreamer_send_bus_call(GstBus *bus, GstMessage *msg, gpointer data) {
+  SampleHandlerUserData *s = (SampleHandlerUserData *)data;
+
   switch (GST_MESSAGE_TYPE(msg)) {
 
   case GST_MESSAGE_EOS:
-    g_print("End of stream\n");
-    exit(1);
-    break;
+    goHandlePipelineEnd(s->pipelineId, "end of stream");
+    return FALSE;
 
   case GST_MESSAGE_ERROR: {
     gchar *debug;
@@ -28,9 +30,9 @@ static gboolean gstreamer_send_bus_call(GstBus *bus, GstMessage *msg, gpointer d
     gst_message_parse_error(msg, &error, &debug);
     g_free(debug);
 
-    g_printerr("Error: %s\n", error->message);
+    goHandlePipelineEnd(s->pipelineId, error->message);
     g_error_free(error);
-    exit(1);
+    return FALSE;
   }
   default:
     break;
@@ -59,10 +61,20 @@ GstFlowReturn gstreamer_send_new_sample_handler(GstElement *object, gpointer use
   return GST_FLOW_OK;
 }
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline) {
+// returns NULL and sets errorMessage, to free with g_free, when pipeline does not parse
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **errorMessage) {
   gst_init(NULL, NULL);
   GError *error = NULL;
-  return gst_parse_launch(pipeline, &error);
+  GstElement *element = gst_parse_launch(pipeline, &error);
+  if (error != NULL) {
+    *errorMessage = g_strdup(error->message);
+    g_error_free(error);
+    if (element != NULL) {
+      gst_object_unref(element);
+    }
+    return NULL;
+  }
+  return element;
 }
 
 void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId) {
@@ -70,7 +82,7 @@ void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId) {
   s->pipelineId = pipelineId;
 
   GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
-  gst_bus_add_watch(bus, gstreamer_send_bus_call, NULL);
+  gst_bus_add_watch(bus, gstreamer_send_bus_call, s);
   gst_object_unref(bus);
 
   GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "appsink");
@@ -27,10 +27,12 @@ type Pipeline struct {
 	id        int
 	codecName string
 	clockRate float32
+	onEnd     func(reason string)
 }
 
 var pipelines = make(map[int]*Pipeline)
 var pipelinesLock sync.Mutex
+var nextPipelineID int
 
 const (
 	videoClockRate = 90000
@@ -38,8 +40,8 @@ const (
 	pcmClockRate   = 8000
 )
 
-// CreatePipeline creates a GStreamer Pipeline
-func CreatePipeline(codecName string, tracks []*webrtc.Track, pipelineSrc string) *Pipeline {
+// CreatePipeline creates a GStreamer Pipeline, pipelineSrc is the source up to the encoder
+func CreatePipeline(codecName string, tracks []*webrtc.Track, pipelineSrc string) (*Pipeline, error) {
 	pipelineStr := "appsink name=appsink"
 	var clockRate float32
 
@@ -73,25 +75,41 @@ func CreatePipeline(codecName string, tracks []*webrtc.Track, pipelineSrc string
 		clockRate = pcmClockRate
 
 	default:
-		panic("Unhandled codec " + codecName)
+		return nil, fmt.Errorf("unhandled codec %s", codecName)
 	}
 
 	pipelineStrUnsafe := C.CString(pipelineStr)
 	defer C.free(unsafe.Pointer(pipelineStrUnsafe))
 
+	var errorMessage *C.char
+	element := C.gstreamer_send_create_pipeline(pipelineStrUnsafe, &errorMessage)
+	if element == nil {
+		defer C.g_free(C.gpointer(unsafe.Pointer(errorMessage)))
+		return nil, fmt.Errorf("bad pipeline %s: %s", pipelineStr, C.GoString(errorMessage))
+	}
+
 	pipelinesLock.Lock()
 	defer pipelinesLock.Unlock()
 
 	pipeline := &Pipeline{
-		Pipeline:  C.gstreamer_send_create_pipeline(pipelineStrUnsafe),
+		Pipeline:  element,
 		tracks:    tracks,
-		id:        len(pipelines),
+		id:        nextPipelineID,
 		codecName: codecName,
 		clockRate: clockRate,
 	}
 
+	nextPipelineID++
 	pipelines[pipeline.id] = pipeline
-	return pipeline
+	return pipeline, nil
+}
+
+// OnEnd sets the handler of the pipeline stopping by itself, on error or
+// end of stream, called from the GStreamer main loop
+func (p *Pipeline) OnEnd(f func(reason string)) {
+	pipelinesLock.Lock()
+	p.onEnd = f
+	pipelinesLock.Unlock()
 }
 
 // Start starts the GStreamer Pipeline
@@ -99,26 +117,48 @@ func (p *Pipeline) Start() {
 	C.gstreamer_send_start_pipeline(p.Pipeline, C.int(p.id))
 }
 
-// Stop stops the GStreamer Pipeline
+// Stop stops the GStreamer Pipeline, buffers still in flight are discarded
+// so a new pipeline can feed the same tracks
 func (p *Pipeline) Stop() {
+	pipelinesLock.Lock()
+	delete(pipelines, p.id)
+	pipelinesLock.Unlock()
+
 	C.gstreamer_send_stop_pipeline(p.Pipeline)
 }
 
+//export goHandlePipelineEnd
+func goHandlePipelineEnd(pipelineID C.int, reason *C.char) {
+	pipelinesLock.Lock()
+	pipeline, ok := pipelines[int(pipelineID)]
+	var onEnd func(string)
+	if ok {
+		onEnd = pipeline.onEnd
+	}
+	pipelinesLock.Unlock()
+
+	if ok {
+		pipeline.Stop()
+		if onEnd != nil {
+			onEnd(C.GoString(reason))
+		}
+	}
+}
+
 //export goHandlePipelineBuffer
 func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.int, pipelineID C.int) {
 	pipelinesLock.Lock()
 	pipeline, ok := pipelines[int(pipelineID)]
 	pipelinesLock.Unlock()
 
+	// a stopped pipeline, e.g. after /replace, still flushes a few buffers, they are dropped
 	if ok {
 		samples := uint32(pipeline.clockRate * (float32(duration) / 1000000000))
 		for _, t := range pipeline.tracks {
-			if err := t.WriteSample(media.Sample{Data: C.GoBytes(buffer, bufferLen), Samples: samples}); err != nil {
-				panic(err)
-			}
+			// io.ErrClosedPipe, or a stopped sender, once the track is removed or its
+			// connection closed while the pipeline runs, the sample is dropped too
+			_ = t.WriteSample(media.Sample{Data: C.GoBytes(buffer, bufferLen), Samples: samples})
 		}
-	} else {
-		fmt.Printf("discarding buffer, no pipeline with id %d", int(pipelineID))
 	}
 	C.free(buffer)
 }
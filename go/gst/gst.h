@@ -7,8 +7,9 @@
 #include <stdlib.h>
 
 extern void goHandlePipelineBuffer(void *buffer, int bufferLen, int samples, int pipelineId);
+extern void goHandlePipelineEnd(int pipelineId, char *reason);
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline);
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **errorMessage);
 void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId);
 void gstreamer_send_stop_pipeline(GstElement *pipeline);
 void gstreamer_send_start_mainloop(void);
@@ -2,16 +2,93 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 	"strings"
 
 	"testrtc2/network"
+	"testrtc2/protocol"
 	"testrtc2/screen"
 )
 
 func main() {
-	addr := flag.String("addr", "192.168.1.104:6789", "websocket signal server")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "token":
+			token(os.Args[2:])
+			return
+		}
+	}
+
+	addr := flag.String("addr", "192.168.1.104:6789", "websocket signal server, host:port or full ws:// wss:// URL")
+	caFile := flag.String("ca", "", "CA bundle to verify wss:// server")
+	certFile := flag.String("cert", "", "client certificate for wss://")
+	keyFile := flag.String("key", "", "client certificate key for wss://")
+	insecure := flag.Bool("insecure", false, "skip verifying wss:// server certificate")
+	authToken := flag.String("token", "", "signal server authentication token")
+	tokenInQuery := flag.Bool("token-query", false, "send token as ?token= instead of Authorization: Bearer header")
+	recordFile := flag.String("record", "", "record all signaling packets to this JSONL file")
+	replayFile := flag.String("replay", "", "replay a recording made with -record on start")
+	encoding := flag.String("encoding", "base64", "sdp + candidate encoding: base64, json, deflate, gzip (web and flutter clients need base64)")
+	iceFilter := flag.String("icefilter", "", "drop candidates matching rules, e.g. type!=relay or ip=ipv6,proto=tcp")
+	manualMode := flag.Bool("manual", false, "no signal server, copy/paste sdp + candidates blobs by hand")
+	configFile := flag.String("config", "", "JSON config file, flags given override its values")
+	profile := flag.String("profile", "", "named profile of the config file")
+	settingsFlags := registerSettingsFlags()
 	flag.Parse()
 
+	var config *clientConfig
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile, *profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load config failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		given := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+		if !given["addr"] && config.Addr != "" {
+			*addr = config.Addr
+		}
+		if !given["token"] && config.Token != "" {
+			*authToken = config.Token
+		}
+		if !given["encoding"] && config.Encoding != "" {
+			*encoding = config.Encoding
+		}
+	} else if *profile != "" {
+		fmt.Fprintln(os.Stderr, "-profile needs -config")
+		os.Exit(1)
+	}
+
+	enc, err := network.ParseEncoding(*encoding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	filter, err := network.ParseCandidateFilter(*iceFilter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	settings, err := settingsFlags.settings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	tlsConfig, err := network.LoadTLSConfig(*caFile, *certFile, *keyFile, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load tls config failed: %v\n", err)
+		os.Exit(1)
+	}
+
 	quit := make(chan struct{})
 
 	// terminal
@@ -25,31 +102,157 @@ func main() {
 
 	// create websocket + webrtc
 	ws := network.NewWebSocket(screen)
+	ws.SetTLSConfig(tlsConfig)
+	ws.SetAuthToken(*authToken, *tokenInQuery)
+	if *recordFile != "" {
+		recorder, err := network.NewRecorder(*recordFile)
+		if err != nil {
+			screen.Log("[System] open record file failed: " + err.Error())
+		} else {
+			defer recorder.Close()
+			ws.SetRecorder(recorder)
+			screen.Log("[System] Recording signaling to " + *recordFile)
+		}
+	}
 	rtc := network.NewWebRTC(screen)
 	ws.SetWebRTC(rtc)
-	rtc.SetWebSocket(ws)
+	rtc.SetSignaling(ws)
+	if enc != network.EncodingBase64 {
+		rtc.SetEncoding(enc)
+	}
+	if len(filter) > 0 {
+		rtc.SetCandidateFilter(filter)
+	}
+	err = rtc.SetSettings(settings)
+	if err != nil {
+		screen.Fini()
+		fmt.Fprintf(os.Stderr, "bad settings: %v\n", err)
+		os.Exit(1)
+	}
+	if config != nil {
+		err = applyConfig(rtc, config)
+		if err != nil {
+			screen.Fini()
+			fmt.Fprintf(os.Stderr, "bad config: %v\n", err)
+			os.Exit(1)
+		}
+		if *profile != "" {
+			screen.Log(fmt.Sprintf("[System] Loaded config %s, profile %s", *configFile, *profile))
+		} else {
+			screen.Log("[System] Loaded config " + *configFile)
+		}
+	}
+
+	// manual mode replaces websocket, blobs are pasted into input box
+	var manual *network.ManualSignal
+	if *manualMode {
+		manual = network.NewManualSignal(screen)
+		manual.SetWebRTC(rtc)
+		rtc.SetSignaling(manual)
+		screen.Log("[System] Manual signaling: /new, then /offer or paste the remote blob")
+	}
 
 	// register createOffer callback
 	screen.RegisterCallback(func(data string) {
-		if data == "/new" {
+		if data == "/new" && manual != nil {
+			manual.Reset()
+			rtc.Init()
+		} else if data == "/new" {
 			// run in routine, dial might take long time
 			// also init webrtc when establishing ws connection
 			go ws.Connect(*addr)
+		} else if data == "/blob" && manual != nil {
+			manual.PrintBlob()
+		} else if manual != nil && data != "" && !strings.HasPrefix(data, "/") {
+			manual.Paste(data)
 		} else if strings.HasPrefix(data, "/peer ") {
 			peerID := data[6:]
 			ws.SetPeer(peerID)
-		} else if data == "/media" {
-			rtc.AddMedia()
+		} else if strings.HasPrefix(data, "/replay ") {
+			path := data[8:]
+			go ws.Replay(path)
+		} else if strings.HasPrefix(data, "/encoding ") {
+			enc, err := network.ParseEncoding(data[10:])
+			if err != nil {
+				screen.Log("[System] " + err.Error())
+			} else {
+				rtc.SetEncoding(enc)
+			}
+		} else if data == "/ping" {
+			ws.Ping()
+		} else if strings.HasPrefix(data, "/join ") {
+			room := data[6:]
+			ws.Join(room)
+		} else if data == "/leave" {
+			ws.Leave()
+		} else if data == "/members" {
+			ws.RequestMembers()
+		} else if data == "/broadcast" {
+			ws.BroadcastMessage(protocol.Message{Topic: "ping"})
+		} else if data == "/peers" {
+			rtc.LogPeers()
+		} else if data == "/media" || strings.HasPrefix(data, "/media ") {
+			rtc.AddMedia(strings.TrimPrefix(data, "/media"))
+		} else if strings.HasPrefix(data, "/replace ") {
+			rtc.Replace(data[9:])
 		} else if data == "/data" {
 			rtc.CreateDataChannel()
+		} else if strings.HasPrefix(data, "/transceiver ") {
+			rtc.Transceiver(data[13:])
+		} else if data == "/transceivers" {
+			rtc.LogTransceivers()
+		} else if data == "/codecs" || strings.HasPrefix(data, "/codecs ") {
+			rtc.Codecs(strings.TrimPrefix(data, "/codecs"))
 		} else if data == "/offer" {
 			rtc.CreateOffer()
+		} else if data == "/answer" {
+			rtc.CreateAnswer()
+		} else if data == "/sdpmode manual" {
+			rtc.SetManualSDP(true)
+		} else if data == "/sdpmode auto" {
+			rtc.SetManualSDP(false)
+		} else if data == "/setlocal" {
+			rtc.SetLocal()
+		} else if data == "/sendsdp" {
+			rtc.SendSDP()
+		} else if data == "/setremote" {
+			// an offer set twice before the answer hangs in pion v2, keep input alive
+			go rtc.SetRemote()
+		} else if data == "/rollback" {
+			rtc.Rollback()
+		} else if data == "/restartice" {
+			rtc.RestartICE()
+		} else if data == "/config" || strings.HasPrefix(data, "/config ") {
+			rtc.Configure(strings.TrimPrefix(data, "/config"))
+		} else if data == "/icemode manual" {
+			rtc.SetManualICE(true)
+		} else if data == "/icemode auto" {
+			rtc.SetManualICE(false)
+		} else if data == "/sendice" {
+			rtc.SendHeldCandidates()
+		} else if data == "/addice" {
+			rtc.AddHeldCandidates()
+		} else if data == "/icequeue" {
+			rtc.LogHeldCandidates()
+		} else if data == "/icefilter off" {
+			rtc.SetCandidateFilter(nil)
+		} else if strings.HasPrefix(data, "/icefilter ") {
+			filter, err := network.ParseCandidateFilter(data[11:])
+			if err != nil {
+				screen.Log("[System] " + err.Error())
+			} else {
+				rtc.SetCandidateFilter(filter)
+			}
 		} else {
 			screen.Log("[System] Unknown command")
 		}
 		screen.SetBuffer("")
 	})
 
+	if *replayFile != "" {
+		go ws.Replay(*replayFile)
+	}
+
 	<-quit
 	screen.Fini()
 }
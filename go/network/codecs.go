@@ -0,0 +1,218 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// CodecPreference is a codec registered to the MediaEngine of new peer connections
+type CodecPreference struct {
+	Name string // key of mediaCodecs, e.g. h264
+	Fmtp string // empty for the pion default
+}
+
+// ParseCodecs parses comma separated codecs in order of preference, each with
+// optional fmtp after a colon, empty or default for the pion defaults, e.g.
+//
+//	h264:profile-level-id=42e01f;packetization-mode=1,pcmu
+func ParseCodecs(spec string) ([]CodecPreference, error) {
+	if spec == "" || spec == "default" {
+		return nil, nil
+	}
+
+	var prefs []CodecPreference
+	for _, item := range strings.Split(spec, ",") {
+		kv := strings.SplitN(item, ":", 2)
+		pref := CodecPreference{Name: strings.ToLower(kv[0])}
+		if len(kv) == 2 {
+			pref.Fmtp = kv[1]
+		}
+		if _, ok := mediaCodecs[pref.Name]; !ok {
+			return nil, fmt.Errorf("bad codec %s, need vp8, vp9, h264, opus, g722, pcmu or pcma", kv[0])
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, nil
+}
+
+// newRTPCodec makes the pion codec of name with its clock rate
+func newRTPCodec(name string, payloadType uint8) *webrtc.RTPCodec {
+	switch name {
+	case webrtc.VP8:
+		return webrtc.NewRTPVP8Codec(payloadType, 90000)
+	case webrtc.VP9:
+		return webrtc.NewRTPVP9Codec(payloadType, 90000)
+	case webrtc.H264:
+		return webrtc.NewRTPH264Codec(payloadType, 90000)
+	case webrtc.Opus:
+		return webrtc.NewRTPOpusCodec(payloadType, 48000)
+	case webrtc.G722:
+		return webrtc.NewRTPG722Codec(payloadType, 8000)
+	case webrtc.PCMU:
+		return webrtc.NewRTPPCMUCodec(payloadType, 8000)
+	default:
+		return webrtc.NewRTPPCMACodec(payloadType, 8000)
+	}
+}
+
+// registerCodecs registers prefs in order, kinds without any keep the pion defaults
+// a codec listed again, e.g. h264 with another fmtp, gets a free dynamic payload type
+func registerCodecs(m *webrtc.MediaEngine, prefs []CodecPreference) {
+	defaults := webrtc.MediaEngine{}
+	defaults.RegisterDefaultCodecs()
+
+	used := make(map[uint8]bool)
+	for _, kind := range mediaKinds {
+		listed := false
+		for _, pref := range prefs {
+			codec := mediaCodecs[pref.Name]
+			if codec.kind != kind {
+				continue
+			}
+			listed = true
+
+			payloadType := codec.payloadType
+			for dynamic := uint8(127); used[payloadType] && dynamic >= 96; dynamic-- {
+				payloadType = dynamic
+			}
+			used[payloadType] = true
+
+			c := newRTPCodec(codec.name, payloadType)
+			if pref.Fmtp != "" {
+				c.SDPFmtpLine = pref.Fmtp
+			}
+			m.RegisterCodec(c)
+		}
+
+		if !listed {
+			for _, c := range defaults.GetCodecsByKind(kind) {
+				used[c.PayloadType] = true
+				m.RegisterCodec(c)
+			}
+		}
+	}
+}
+
+// SetCodecs sets the codecs of new peer connections, nil for the pion defaults
+func (rtc *WebRTC) SetCodecs(prefs []CodecPreference) {
+	rtc.mu.Lock()
+	rtc.settings.Codecs = prefs
+	rtc.mu.Unlock()
+}
+
+// Codecs handles /codecs arguments:
+//
+//	show
+//	default
+//	codec[:fmtp],...    e.g. pcmu or h264:profile-level-id=42e01f;packetization-mode=1,vp8
+func (rtc *WebRTC) Codecs(args string) {
+	args = strings.TrimSpace(args)
+	if args == "" || args == "show" {
+		rtc.ShowCodecs()
+		return
+	}
+
+	prefs, err := ParseCodecs(args)
+	if err != nil {
+		rtc.screen.Log("[Codec] " + err.Error())
+		return
+	}
+	rtc.SetCodecs(prefs)
+	rtc.ShowCodecs()
+	rtc.screen.Log("[Codec] applies to new peer connections, /new to start over")
+}
+
+// ShowCodecs prints the codecs of new peer connections in order of preference
+func (rtc *WebRTC) ShowCodecs() {
+	m := webrtc.MediaEngine{}
+	registerCodecs(&m, rtc.getSettings().Codecs)
+
+	for _, kind := range mediaKinds {
+		var names []string
+		for _, c := range m.GetCodecsByKind(kind) {
+			name := fmt.Sprintf("%s/%d pt %d", c.Name, c.ClockRate, c.PayloadType)
+			if c.SDPFmtpLine != "" {
+				name += " " + c.SDPFmtpLine
+			}
+			names = append(names, name)
+		}
+		rtc.screen.Log(fmt.Sprintf("[Codec] %s: %s", kind, strings.Join(names, ", ")))
+	}
+}
+
+// payloadType is the payload type of codec registered to the peer connection
+func (p *peer) payloadType(codec mediaCodec) (uint8, error) {
+	for _, c := range p.conn.GetRegisteredRTPCodecs(codec.kind) {
+		if strings.EqualFold(c.Name, codec.name) {
+			return c.PayloadType, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not in the codecs of the peer connection, see /codecs", codec.name)
+}
+
+// negotiatedPayload is the first payload type of the answer section also offered,
+// with the fmtp it was offered with, empty if rejected or nothing in common
+func negotiatedPayload(offered []sdpMedia, answer sdpMedia) (string, string) {
+	for _, o := range offered {
+		if o.mid != answer.mid {
+			continue
+		}
+		for _, pt := range answer.formats {
+			for _, opt := range o.formats {
+				if strings.EqualFold(answer.rtpmap[pt], o.rtpmap[opt]) && answer.rtpmap[pt] != "" {
+					return pt, o.fmtp[opt]
+				}
+			}
+		}
+	}
+	return "", ""
+}
+
+// logCodecs logs the codec negotiated for each m= section once the answer is set,
+// warning when the local track sends another one, pion v2 does not switch it
+func (p *peer) logCodecs() {
+	local, remote := p.conn.LocalDescription(), p.conn.RemoteDescription()
+	if local == nil || remote == nil {
+		return
+	}
+	offer, answer := local, remote
+	if local.Type == webrtc.SDPTypeAnswer {
+		offer, answer = remote, local
+	}
+	offered := parseMediaSections(offer.SDP)
+
+	transceivers := p.conn.GetTransceivers()
+	mids := p.transceiverMids(transceivers)
+	for _, m := range parseMediaSections(answer.SDP) {
+		if m.kind == "application" {
+			continue
+		}
+		pt, offeredFmtp := negotiatedPayload(offered, m)
+		if pt == "" {
+			p.screen.Log(fmt.Sprintf("[Codec] %s mid %s %s: no common codec", p.id, m.mid, m.kind))
+			continue
+		}
+
+		line := fmt.Sprintf("[Codec] %s mid %s %s: %s pt %s", p.id, m.mid, m.kind, m.rtpmap[pt], pt)
+		if fmtp := m.fmtp[pt]; fmtp != "" {
+			line += " " + fmtp
+		}
+		if offeredFmtp != m.fmtp[pt] {
+			line += " (offered " + offeredFmtp + ")"
+		}
+		for i, t := range transceivers {
+			if mids[i].mid != m.mid || t.Sender() == nil || t.Sender().Track() == nil {
+				continue
+			}
+			track := t.Sender().Track()
+			if strings.HasPrefix(strings.ToLower(m.rtpmap[pt]), strings.ToLower(track.Codec().Name)+"/") {
+				line += ", track " + track.ID()
+			} else {
+				line += fmt.Sprintf(", but track %s sends %s", track.ID(), track.Codec().Name)
+			}
+		}
+		p.screen.Log(line)
+	}
+}
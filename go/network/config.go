@@ -0,0 +1,187 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var (
+	transportPolicies = map[string]webrtc.ICETransportPolicy{
+		"all":   webrtc.ICETransportPolicyAll,
+		"relay": webrtc.ICETransportPolicyRelay,
+	}
+	bundlePolicies = map[string]webrtc.BundlePolicy{
+		"balanced":   webrtc.BundlePolicyBalanced,
+		"max-compat": webrtc.BundlePolicyMaxCompat,
+		"max-bundle": webrtc.BundlePolicyMaxBundle,
+	}
+	rtcpMuxPolicies = map[string]webrtc.RTCPMuxPolicy{
+		"negotiate": webrtc.RTCPMuxPolicyNegotiate,
+		"require":   webrtc.RTCPMuxPolicyRequire,
+	}
+)
+
+// DefaultConfiguration is one Google STUN server with default policies
+func DefaultConfiguration() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		BundlePolicy:       webrtc.BundlePolicyBalanced,
+		RTCPMuxPolicy:      webrtc.RTCPMuxPolicyRequire,
+	}
+}
+
+// NewICEServer makes a STUN or TURN server, TURN needs username + credential
+// urls are comma separated, e.g. turn:host:3478?transport=udp,turn:host:3478?transport=tcp
+func NewICEServer(urls, username, credential string) (webrtc.ICEServer, error) {
+	server := webrtc.ICEServer{URLs: strings.Split(urls, ",")}
+	for _, u := range server.URLs {
+		switch {
+		case strings.HasPrefix(u, "stun:"), strings.HasPrefix(u, "stuns:"):
+		case strings.HasPrefix(u, "turn:"), strings.HasPrefix(u, "turns:"):
+			if username == "" || credential == "" {
+				return server, fmt.Errorf("TURN server %s needs username and credential", u)
+			}
+		default:
+			return server, fmt.Errorf("bad ICE server %s, need stun: stuns: turn: or turns: URL", u)
+		}
+	}
+
+	if username != "" {
+		server.Username = username
+		server.Credential = credential
+		server.CredentialType = webrtc.ICECredentialTypePassword
+	}
+	return server, nil
+}
+
+// SetConfiguration sets the configuration of new peer connections
+func (rtc *WebRTC) SetConfiguration(config webrtc.Configuration) {
+	rtc.mu.Lock()
+	rtc.config = config
+	rtc.mu.Unlock()
+}
+
+func (rtc *WebRTC) configuration() webrtc.Configuration {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	config := rtc.config
+	config.ICEServers = append([]webrtc.ICEServer{}, config.ICEServers...)
+	return config
+}
+
+// Configure handles /config arguments:
+//
+//	show
+//	ice add url[,url] [username credential]
+//	ice clear
+//	policy all|relay
+//	bundle balanced|max-compat|max-bundle
+//	rtcpmux negotiate|require
+//	pool n
+//
+// and the SettingEngine options, see configureSettings
+func (rtc *WebRTC) Configure(args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || fields[0] == "show" {
+		rtc.ShowConfiguration()
+		return
+	}
+
+	if ok, err := rtc.configureSettings(fields); ok {
+		if err != nil {
+			rtc.screen.Log("[Config] " + err.Error())
+			return
+		}
+		rtc.screen.Log("[Config] set " + strings.Join(fields, " "))
+		rtc.screen.Log("[Config] applies to new peer connections, /new to start over")
+		return
+	}
+
+	config := rtc.configuration()
+	var err error
+
+	switch {
+	case fields[0] == "ice" && len(fields) >= 3 && fields[1] == "add":
+		username, credential := "", ""
+		if len(fields) == 5 {
+			username, credential = fields[3], fields[4]
+		} else if len(fields) != 3 {
+			err = fmt.Errorf("usage: /config ice add url[,url] [username credential]")
+			break
+		}
+		var server webrtc.ICEServer
+		server, err = NewICEServer(fields[2], username, credential)
+		config.ICEServers = append(config.ICEServers, server)
+
+	case fields[0] == "ice" && len(fields) == 2 && fields[1] == "clear":
+		config.ICEServers = nil
+
+	case fields[0] == "policy" && len(fields) == 2:
+		policy, ok := transportPolicies[fields[1]]
+		if !ok {
+			err = fmt.Errorf("bad transport policy %s, need all or relay", fields[1])
+		}
+		config.ICETransportPolicy = policy
+
+	case fields[0] == "bundle" && len(fields) == 2:
+		policy, ok := bundlePolicies[fields[1]]
+		if !ok {
+			err = fmt.Errorf("bad bundle policy %s, need balanced, max-compat or max-bundle", fields[1])
+		}
+		config.BundlePolicy = policy
+
+	case fields[0] == "rtcpmux" && len(fields) == 2:
+		policy, ok := rtcpMuxPolicies[fields[1]]
+		if !ok {
+			err = fmt.Errorf("bad rtcp mux policy %s, need negotiate or require", fields[1])
+		}
+		config.RTCPMuxPolicy = policy
+
+	case fields[0] == "pool" && len(fields) == 2:
+		var size int
+		size, err = strconv.Atoi(fields[1])
+		if err == nil && (size < 0 || size > 255) {
+			err = fmt.Errorf("candidate pool size %d out of 0-255", size)
+		}
+		config.ICECandidatePoolSize = uint8(size)
+
+	default:
+		err = fmt.Errorf("usage: /config show|ice add|ice clear|policy|bundle|rtcpmux|pool|ports|nat|network|timeout|wait")
+	}
+
+	if err != nil {
+		rtc.screen.Log("[Config] " + err.Error())
+		return
+	}
+
+	// pion v2 gathers with the ICE servers and policy given at creation,
+	// SetConfiguration of a running peer connection only stores them
+	rtc.SetConfiguration(config)
+	rtc.screen.Log("[Config] set " + strings.Join(fields, " "))
+	rtc.screen.Log("[Config] applies to new peer connections, /new to start over")
+}
+
+// ShowConfiguration prints the configuration of new peer connections
+func (rtc *WebRTC) ShowConfiguration() {
+	config := rtc.configuration()
+
+	rtc.screen.Log(fmt.Sprintf("[Config] %d ICE servers", len(config.ICEServers)))
+	for _, server := range config.ICEServers {
+		line := "  " + strings.Join(server.URLs, ",")
+		if server.Username != "" {
+			line += " username=" + server.Username + " credential=***"
+		}
+		rtc.screen.Log(line)
+	}
+	rtc.screen.Log(fmt.Sprintf("[Config] transport policy %s, bundle policy %s, rtcp mux policy %s, candidate pool %d",
+		config.ICETransportPolicy, config.BundlePolicy, config.RTCPMuxPolicy, config.ICECandidatePoolSize))
+	rtc.showSettings()
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// glareCounter counts remote offers colliding with our own offer
+type glareCounter struct {
+	collisions int
+	rolledBack int
+	ignored    int
+}
+
+func (c glareCounter) String() string {
+	return fmt.Sprintf("collisions=%d rolledback=%d ignored=%d", c.collisions, c.rolledBack, c.ignored)
+}
+
+// compareIDs orders server IDs numerically, e.g. 9 < 10
+func compareIDs(a, b string) int {
+	switch {
+	case len(a) != len(b):
+		return len(a) - len(b)
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// polite tells our role towards the peer, the newer client (higher ID) is polite
+// and gives way when offers collide, the older one keeps its offer
+func (p *peer) polite() bool {
+	return compareIDs(p.rtc.signal.GetID(), p.id) > 0
+}
+
+func (p *peer) role() string {
+	if p.polite() {
+		return "polite"
+	}
+	return "impolite"
+}
+
+// handleGlare handles a remote offer colliding with ours,
+// returns true if the remote offer should be applied
+func (p *peer) handleGlare() bool {
+	p.glare.collisions++
+	state := p.conn.SignalingState()
+
+	if !p.polite() {
+		p.ignoreOffer = true
+		p.glare.ignored++
+		p.screen.Log(fmt.Sprintf("[Glare] %s: offer collides with ours (%s), impolite, ignore it (%s)", p.id, state, p.glare))
+		return false
+	}
+
+	if p.negotiated() {
+		// a rebuild would drop the established call for one offer
+		p.ignoreOffer = true
+		p.glare.ignored++
+		p.screen.Log(fmt.Sprintf("[Glare] %s: offer collides with ours (%s), polite, but pion cannot roll back, keep the connection and ignore it (%s)", p.id, state, p.glare))
+		return false
+	}
+
+	p.screen.Log(fmt.Sprintf("[Glare] %s: offer collides with ours (%s), polite, roll back (%s)", p.id, state, p.glare))
+	err := p.rollback()
+	if err != nil {
+		p.screen.Log("[Glare] roll back failed: " + err.Error())
+		return false
+	}
+	p.glare.rolledBack++
+	return true
+}
+
+// negotiated tells if an offer was answered, transports run on the peer connection
+func (p *peer) negotiated() bool {
+	return p.conn.CurrentRemoteDescription() != nil
+}
+
+// rollback drops the pending local or remote offer, back to stable
+// pion v2 has no rollback transition, so the peer connection is rebuilt,
+// keeping local data channel + media. Once negotiated that would drop the call,
+// then it is refused
+func (p *peer) rollback() error {
+	state := p.conn.SignalingState()
+	if state != webrtc.SignalingStateHaveLocalOffer && state != webrtc.SignalingStateHaveRemoteOffer {
+		return fmt.Errorf("nothing to roll back in %s", state)
+	}
+	if p.negotiated() {
+		return fmt.Errorf("pion cannot roll back %s, a rebuild would drop the negotiated call, /new to start over", state)
+	}
+
+	p.screen.Log(fmt.Sprintf("[WebRTC] pion cannot roll back %s, rebuild peer connection", state))
+	return p.rebuild()
+}
+
+// rebuild replaces the peer connection by a fresh one, restoring local data channel,
+// media and transceivers in the order of the old one, so m= sections keep their place
+func (p *peer) rebuild() error {
+	var media []*mediaTrack
+	var specs []*transceiverSpec
+	seenMedia, seenSpecs := map[*mediaTrack]bool{}, map[*transceiverSpec]bool{}
+	for _, t := range p.conn.GetTransceivers() {
+		m, spec := p.transceiverOwner(t)
+		if m != nil || spec != nil {
+			media = append(media, m)
+			specs = append(specs, spec)
+			seenMedia[m], seenSpecs[spec] = true, true
+		}
+	}
+	// added since, not in the old peer connection yet
+	for _, kind := range mediaKinds {
+		if m := p.media[kind]; m != nil && !seenMedia[m] {
+			media = append(media, m)
+			specs = append(specs, nil)
+		}
+	}
+	for _, spec := range p.transceivers {
+		if !seenSpecs[spec] {
+			media = append(media, nil)
+			specs = append(specs, spec)
+		}
+	}
+
+	p.stopPipe()
+	p.dropCandidates()
+	p.conn.Close()
+	p.isOffering = false
+	p.isPeered = false
+
+	err := p.connect(p.rtc.configuration(), p.rtc.getSettings())
+	if err != nil {
+		return err
+	}
+	if p.hasData {
+		p.createDataChannel()
+	}
+	for i, m := range media {
+		if m != nil {
+			p.startMedia(m)
+			continue
+		}
+		err = p.createTransceiver(specs[i])
+		if err != nil {
+			p.screen.Log(fmt.Sprintf("[Transceiver] restore %s %s failed: %s", specs[i].kind, specs[i].direction, err))
+		}
+	}
+	return nil
+}
+
+// transceiverOwner returns the /media track or /transceiver spec the transceiver was added for
+func (p *peer) transceiverOwner(t *webrtc.RTPTransceiver) (*mediaTrack, *transceiverSpec) {
+	for _, kind := range mediaKinds {
+		if m := p.media[kind]; m != nil && m.sender != nil && t.Sender() == m.sender {
+			return m, nil
+		}
+	}
+	return nil, p.transceiverSpec(t)
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"testrtc2/protocol"
+)
+
+const (
+	ClientName    = "go"
+	ClientVersion = "2.0"
+)
+
+// Hello tells the peer which topics and features this client supports
+type Hello struct {
+	Client   string   `json:"client"`
+	Version  string   `json:"version"`
+	Topics   []string `json:"topics"`
+	Features []string `json:"features"`
+}
+
+// features this client can do, checked by the peer before relying on them
+const (
+	FeatureAnswer      = "answer"      // answer remote offer
+	FeatureMedia       = "media"       // send media tracks
+	FeatureDataChannel = "datachannel" // create / accept data channel
+	FeatureICERestart  = "icerestart"  // answer ICE restart offer
+)
+
+var localHello = Hello{
+	Client:   ClientName,
+	Version:  ClientVersion,
+	Topics:   []string{"ping", "pong", "sdp", "candidate", "hello"},
+	Features: []string{FeatureAnswer, FeatureMedia, FeatureDataChannel, FeatureICERestart, "encoding:json", "encoding:deflate", "encoding:gzip"},
+}
+
+func (h *Hello) String() string {
+	return fmt.Sprintf("%s %s, topics: %s, features: %s", h.Client, h.Version, strings.Join(h.Topics, " "), strings.Join(h.Features, " "))
+}
+
+func (h *Hello) has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// SendHello tells peer id our capabilities
+func (rtc *WebRTC) SendHello(id string) {
+	if p := rtc.getPeer(id); p != nil {
+		p.locked((*peer).sendHello)
+	}
+}
+
+func (p *peer) sendHello() {
+	body, err := Encode(localHello)
+	if err != nil {
+		p.screen.Log("[Hello] encode failed: " + err.Error())
+		return
+	}
+	p.greeted = true
+	p.send(protocol.Message{Topic: "hello", Body: body})
+}
+
+func (p *peer) handleHello(body string) {
+	var hello Hello
+	err := Decode(body, &hello)
+	if err != nil {
+		p.screen.Log("[Hello] decode failed: " + err.Error())
+		return
+	}
+	p.remoteHello = &hello
+	p.screen.Log(fmt.Sprintf("[Hello] peer %s is %s", p.id, hello.String()))
+}
+
+// checkPeer warns when the peer said hello without the feature
+// peers never saying hello (web, flutter) are not checked
+func (p *peer) checkPeer(feature string) {
+	hello := p.remoteHello
+	if hello != nil && !hello.has(feature) {
+		p.screen.Log(fmt.Sprintf("[Hello] warning: peer %s (%s %s) lacks feature %s", p.id, hello.Client, hello.Version, feature))
+	}
+}
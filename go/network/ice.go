@@ -0,0 +1,179 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"testrtc2/protocol"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// iceCounter counts remote candidates arriving before the remote sdp
+type iceCounter struct {
+	queued  int
+	flushed int
+	dropped int
+}
+
+func (c iceCounter) String() string {
+	return fmt.Sprintf("queued=%d flushed=%d dropped=%d", c.queued, c.flushed, c.dropped)
+}
+
+// addRemoteCandidate adds the candidate, or queues it until the remote sdp is set
+func (p *peer) addRemoteCandidate(ice webrtc.ICECandidateInit) {
+	if p.conn.RemoteDescription() == nil {
+		p.earlyCandidates = append(p.earlyCandidates, ice)
+		p.iceCounter.queued++
+		p.screen.Log(fmt.Sprintf("[ICE] no remote sdp yet, queue candidate (%s)", p.iceCounter))
+		return
+	}
+
+	err := p.conn.AddICECandidate(ice)
+	if err != nil && p.ignoreOffer {
+		p.screen.Log("[Glare] candidate of ignored offer failed, ignored: " + err.Error())
+		return
+	}
+	if err != nil {
+		p.screen.Log("[WebRTC] add IceCandidate failed: " + err.Error())
+		return
+	}
+	p.screen.Log("[WebRTC] add IceCandidate from peer")
+}
+
+// flushCandidates adds the queued candidates, once the remote sdp is set
+func (p *peer) flushCandidates() {
+	if len(p.earlyCandidates) == 0 {
+		return
+	}
+
+	for _, ice := range p.earlyCandidates {
+		err := p.conn.AddICECandidate(ice)
+		if err != nil {
+			p.iceCounter.dropped++
+			p.screen.Log("[ICE] add queued candidate failed: " + err.Error())
+			continue
+		}
+		p.iceCounter.flushed++
+	}
+	p.earlyCandidates = nil
+	p.screen.Log(fmt.Sprintf("[ICE] flush queued candidates (%s)", p.iceCounter))
+}
+
+// dropCandidates forgets the queued candidates with the peer connection
+func (p *peer) dropCandidates() {
+	if len(p.earlyCandidates) > 0 {
+		p.iceCounter.dropped += len(p.earlyCandidates)
+		p.screen.Log(fmt.Sprintf("[ICE] drop queued candidates (%s)", p.iceCounter))
+	}
+	p.earlyCandidates = nil
+	p.iceCounter = iceCounter{}
+}
+
+func (p *peer) sendLocalCandidate(ice webrtc.ICECandidateInit) {
+	if p.rtc.filterCandidate(ice, "local") {
+		return
+	}
+	if p.holdCandidate(&p.localCandidates, ice, "local") {
+		return
+	}
+
+	body, err := EncodeWith(ice, p.rtc.getEncoding())
+	if err != nil {
+		p.screen.Log("[WebRTC] encode IceCandidate failed")
+		return
+	}
+	p.send(protocol.Message{Topic: "candidate", Body: body})
+}
+
+// SetManualICE holds local and remote candidates until released by
+// SendHeldCandidates and AddHeldCandidates, like web client buttons
+func (rtc *WebRTC) SetManualICE(manual bool) {
+	rtc.iceMu.Lock()
+	rtc.manualICE = manual
+	rtc.iceMu.Unlock()
+
+	if manual {
+		rtc.screen.Log("[ICE] manual mode: /sendice, /addice to release held candidates")
+	} else {
+		rtc.screen.Log("[ICE] auto mode, held candidates stay until released")
+	}
+}
+
+// holdCandidate keeps the candidate in queue when in manual mode
+func (p *peer) holdCandidate(queue *[]webrtc.ICECandidateInit, ice webrtc.ICECandidateInit, side string) bool {
+	p.rtc.iceMu.Lock()
+	defer p.rtc.iceMu.Unlock()
+	if !p.rtc.manualICE {
+		return false
+	}
+
+	*queue = append(*queue, ice)
+	p.screen.Log(fmt.Sprintf("[ICE] hold %s candidate of %s, %d held", side, p.id, len(*queue)))
+	return true
+}
+
+func (p *peer) takeHeld(queue *[]webrtc.ICECandidateInit) []webrtc.ICECandidateInit {
+	p.rtc.iceMu.Lock()
+	defer p.rtc.iceMu.Unlock()
+	held := *queue
+	*queue = nil
+	return held
+}
+
+// SendHeldCandidates sends the held local candidates to the target peers
+func (rtc *WebRTC) SendHeldCandidates() {
+	rtc.withTargets(func(p *peer) {
+		held := p.takeHeld(&p.localCandidates)
+		sent := 0
+		for _, ice := range held {
+			body, err := EncodeWith(ice, rtc.getEncoding())
+			if err != nil {
+				rtc.screen.Log("[WebRTC] encode IceCandidate failed, dropped: " + ice.Candidate)
+				continue
+			}
+			p.send(protocol.Message{Topic: "candidate", Body: body})
+			sent++
+		}
+		rtc.screen.Log(fmt.Sprintf("[ICE] sent %d of %d held local candidates to %s", sent, len(held), p.id))
+	})
+}
+
+// AddHeldCandidates adds the held remote candidates of the target peers
+func (rtc *WebRTC) AddHeldCandidates() {
+	rtc.withTargets(func(p *peer) {
+		held := p.takeHeld(&p.remoteCandidates)
+		for _, ice := range held {
+			p.addRemoteCandidate(ice)
+		}
+		rtc.screen.Log(fmt.Sprintf("[ICE] released %d held remote candidates of %s", len(held), p.id))
+	})
+}
+
+// LogHeldCandidates prints the held candidates of every peer
+func (rtc *WebRTC) LogHeldCandidates() {
+	rtc.iceMu.Lock()
+	manual := rtc.manualICE
+	rtc.iceMu.Unlock()
+
+	mode := "auto"
+	if manual {
+		mode = "manual"
+	}
+	rtc.screen.Log(fmt.Sprintf("[ICE] %s mode", mode))
+
+	rtc.withAllPeers(func(p *peer) {
+		rtc.iceMu.Lock()
+		local := p.localCandidates
+		remote := p.remoteCandidates
+		rtc.iceMu.Unlock()
+
+		rtc.screen.Log(fmt.Sprintf("[ICE] %s: %d local + %d remote held, early queue %s", p.id, len(local), len(remote), p.iceCounter))
+		for _, ice := range local {
+			rtc.screen.Log("  local : " + strings.TrimPrefix(ice.Candidate, "candidate:"))
+		}
+		for _, ice := range remote {
+			rtc.screen.Log("  remote: " + strings.TrimPrefix(ice.Candidate, "candidate:"))
+		}
+	})
+}
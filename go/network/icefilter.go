@@ -0,0 +1,182 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// candidateRule matches candidates by key = value, or key != value
+// keys: type (host, srflx, prflx, relay), ip (ipv4, ipv6, fqdn), proto (udp, tcp)
+type candidateRule struct {
+	key    string
+	negate bool
+	value  string
+}
+
+func (r candidateRule) String() string {
+	if r.negate {
+		return r.key + "!=" + r.value
+	}
+	return r.key + "=" + r.value
+}
+
+// CandidateFilter drops candidates matching any of its rules
+// e.g. "type!=relay" is relay only, "ip=ipv6,proto=tcp" drops IPv6 and TCP
+type CandidateFilter []candidateRule
+
+var candidateKeys = map[string][]string{
+	"type":  {"host", "srflx", "prflx", "relay"},
+	"ip":    {"ipv4", "ipv6", "fqdn"},
+	"proto": {"udp", "tcp"},
+}
+
+func ParseCandidateFilter(spec string) (CandidateFilter, error) {
+	var filter CandidateFilter
+	for _, token := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var rule candidateRule
+		sep := "="
+		if strings.Contains(token, "!=") {
+			sep = "!="
+			rule.negate = true
+		}
+		parts := strings.SplitN(token, sep, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad rule %s, need key=value or key!=value", token)
+		}
+		rule.key = strings.ToLower(parts[0])
+		rule.value = strings.ToLower(parts[1])
+
+		values, ok := candidateKeys[rule.key]
+		if !ok {
+			return nil, fmt.Errorf("bad rule %s, key is one of type, ip, proto", token)
+		}
+		valid := false
+		for _, v := range values {
+			valid = valid || v == rule.value
+		}
+		if !valid {
+			return nil, fmt.Errorf("bad rule %s, %s is one of %s", token, rule.key, strings.Join(values, ", "))
+		}
+		filter = append(filter, rule)
+	}
+	return filter, nil
+}
+
+func (f CandidateFilter) String() string {
+	if len(f) == 0 {
+		return "off"
+	}
+	var rules []string
+	for _, r := range f {
+		rules = append(rules, r.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+// candidateAttrs reads type, ip and proto of a candidate line
+// candidate:foundation component proto priority address port typ type ...
+func candidateAttrs(candidate string) map[string]string {
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	attrs := map[string]string{}
+	if len(fields) < 8 {
+		return attrs
+	}
+
+	attrs["proto"] = strings.ToLower(fields[2])
+	attrs["type"] = fields[7]
+	ip := net.ParseIP(fields[4])
+	switch {
+	case ip == nil:
+		attrs["ip"] = "fqdn" // e.g. mdns .local
+	case ip.To4() != nil:
+		attrs["ip"] = "ipv4"
+	default:
+		attrs["ip"] = "ipv6"
+	}
+	return attrs
+}
+
+// Match returns the first rule matching the candidate
+func (f CandidateFilter) Match(candidate string) (candidateRule, bool) {
+	attrs := candidateAttrs(candidate)
+	for _, r := range f {
+		value, ok := attrs[r.key]
+		if !ok {
+			continue
+		}
+		if (value == r.value) != r.negate {
+			return r, true
+		}
+	}
+	return candidateRule{}, false
+}
+
+// SetCandidateFilter drops matching candidates, both sent and received
+func (rtc *WebRTC) SetCandidateFilter(filter CandidateFilter) {
+	rtc.iceMu.Lock()
+	rtc.iceFilter = filter
+	rtc.iceMu.Unlock()
+	rtc.screen.Log("[ICE] candidate filter: " + filter.String())
+}
+
+// filterCandidate tells if the candidate is dropped by the filter
+func (rtc *WebRTC) filterCandidate(ice webrtc.ICECandidateInit, side string) bool {
+	rtc.iceMu.Lock()
+	filter := rtc.iceFilter
+	rtc.iceMu.Unlock()
+
+	rule, ok := filter.Match(ice.Candidate)
+	if ok {
+		rtc.screen.Log(fmt.Sprintf("[ICE] drop %s candidate by %s: %s", side, rule, ice.Candidate))
+	}
+	return ok
+}
+
+// filterSDP drops the a=candidate lines of sdp matching the filter, or all of them
+// in manual ICE mode, an sdp carries every candidate gathered so far
+// local candidates are held already by OnICECandidate, remote ones are held here
+func (p *peer) filterSDP(desc webrtc.SessionDescription, side string) webrtc.SessionDescription {
+	p.rtc.iceMu.Lock()
+	manual := p.rtc.manualICE
+	p.rtc.iceMu.Unlock()
+
+	var lines []string
+	dropped := map[string]bool{} // by candidate, repeated in each m= section
+	sections := parseMediaSections(desc.SDP)
+	index := -1
+	for _, line := range strings.Split(desc.SDP, "\n") {
+		attr := strings.TrimSpace(line)
+		if strings.HasPrefix(attr, "m=") {
+			index++
+		}
+		if !strings.HasPrefix(attr, "a=candidate:") {
+			lines = append(lines, line)
+			continue
+		}
+
+		candidate := strings.TrimPrefix(attr, "a=")
+		drop, seen := dropped[candidate]
+		if !seen {
+			ice := webrtc.ICECandidateInit{Candidate: candidate}
+			if index >= 0 {
+				sdpMid, sdpMLineIndex := sections[index].mid, uint16(index)
+				ice.SDPMid, ice.SDPMLineIndex = &sdpMid, &sdpMLineIndex
+			}
+			drop = p.rtc.filterCandidate(ice, side+" sdp")
+			if !drop && manual && side == "remote" {
+				drop = p.holdCandidate(&p.remoteCandidates, ice, side)
+			}
+			drop = drop || manual
+			dropped[candidate] = drop
+		}
+		if !drop {
+			lines = append(lines, line)
+		}
+	}
+
+	desc.SDP = strings.Join(lines, "\n")
+	return desc
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"testrtc2/protocol"
+)
+
+const pollTimeout = 35 * time.Second // server holds a poll for 25s
+
+// pollConn is a packetConn over HTTP long-poll, for networks blocking websocket
+// POST url opens a session, GET url?session= waits for packets, POST url?session= sends one
+type pollConn struct {
+	client *http.Client
+	url    string
+	header http.Header
+	queue  [][]byte
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func dialPoll(u url.URL, header http.Header, tlsConfig *tls.Config) (*pollConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pollConn{
+		client: &http.Client{
+			Timeout:   pollTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		header: header,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	body, err := p.do(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var ps protocol.PollSession
+	err = json.Unmarshal(body, &ps)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	query := u.Query()
+	query.Set("session", ps.Session)
+	u.RawQuery = query.Encode()
+	p.url = u.String()
+	return p, nil
+}
+
+func (p *pollConn) do(ctx context.Context, method, u string, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.header {
+		req.Header[k] = v
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusForbidden:
+		return nil, errRejected
+	}
+	return nil, fmt.Errorf("http %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+func (p *pollConn) ReadPacket() ([]byte, error) {
+	for len(p.queue) == 0 {
+		body, err := p.do(p.ctx, http.MethodGet, p.url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var packets []json.RawMessage
+		err = json.Unmarshal(body, &packets)
+		if err != nil {
+			return nil, err
+		}
+		for _, packet := range packets {
+			p.queue = append(p.queue, packet)
+		}
+	}
+
+	packet := p.queue[0]
+	p.queue = p.queue[1:]
+	return packet, nil
+}
+
+func (p *pollConn) WritePacket(data []byte) error {
+	_, err := p.do(p.ctx, http.MethodPost, p.url, data)
+	return err
+}
+
+func (p *pollConn) Close() error {
+	// stop pending polls, and tell the server in background
+	p.cancel()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.do(ctx, http.MethodDelete, p.url, nil)
+	}()
+	return nil
+}
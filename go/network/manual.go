@@ -0,0 +1,161 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"testrtc2/protocol"
+	"testrtc2/screen"
+)
+
+// manualPrintDelay waits for more candidates before printing the blob
+const manualPrintDelay = time.Second
+
+// manualMaxPending bounds the parts of a wrapped blob, a blob is a few KB
+const manualMaxPending = 64 << 10
+
+// ManualSignal is a Signaling without any server
+// Outgoing sdp + candidates are bundled into one blob printed on screen,
+// the operator copies it to the other side and pastes the remote blob back
+type ManualSignal struct {
+	screen  *screen.Screen
+	rtc     *WebRTC
+	entries []manualEntry
+	pending string // partial paste, e.g. blob wrapped over lines
+	timer   *time.Timer
+	mu      sync.Mutex
+}
+
+// manualEntry is a message with its body decoded, so the blob compresses well
+type manualEntry struct {
+	Topic string          `json:"t"`
+	Data  json.RawMessage `json:"d"`
+}
+
+func NewManualSignal(screen *screen.Screen) *ManualSignal {
+	return &ManualSignal{screen: screen}
+}
+
+func (ms *ManualSignal) SetWebRTC(rtc *WebRTC) {
+	ms.rtc = rtc
+}
+
+// manualPeer is the ID of the only peer, on the other side of copy/paste
+const manualPeer = "manual"
+
+// GetID is unknown, both sides of copy/paste act as impolite peers
+func (ms *ManualSignal) GetID() string {
+	return ""
+}
+
+func (ms *ManualSignal) GetPeers() []string {
+	return []string{manualPeer}
+}
+
+func (ms *ManualSignal) Reset() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries = nil
+	ms.pending = ""
+	if ms.timer != nil {
+		ms.timer.Stop()
+	}
+}
+
+// SendMessage adds msg to the local blob, printed once no more comes for a while
+func (ms *ManualSignal) SendMessage(to string, msg protocol.Message) {
+	var data json.RawMessage
+	if msg.Body != "" {
+		err := Decode(msg.Body, &data)
+		if err != nil {
+			ms.screen.Log("[Manual] decode body failed: " + err.Error())
+			return
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if msg.Topic == "sdp" {
+		// new sdp, previous candidates belong to the old one
+		ms.entries = nil
+	}
+	ms.entries = append(ms.entries, manualEntry{msg.Topic, data})
+	ms.screen.Log(fmt.Sprintf("[Manual] queue <%s> into blob", msg.Topic))
+
+	if ms.timer != nil {
+		ms.timer.Stop()
+	}
+	ms.timer = time.AfterFunc(manualPrintDelay, ms.PrintBlob)
+}
+
+// PrintBlob prints the local blob for the operator to copy
+func (ms *ManualSignal) PrintBlob() {
+	ms.mu.Lock()
+	entries := ms.entries
+	ms.mu.Unlock()
+
+	if len(entries) == 0 {
+		ms.screen.Log("[Manual] Nothing to send yet")
+		return
+	}
+
+	blob, err := EncodeWith(entries, EncodingDeflate)
+	if err != nil {
+		ms.screen.Log("[Manual] encode blob failed: " + err.Error())
+		return
+	}
+	ms.screen.Log(fmt.Sprintf("[Manual] local blob, %d messages, %d chars. Paste it to the other side:", len(entries), len(blob)))
+	ms.screen.Log(blob)
+}
+
+// Paste applies a remote blob, parts of a wrapped blob are joined until it decodes
+// a new blob drops the parts of the previous one
+func (ms *ManualSignal) Paste(data string) {
+	data = strings.TrimSpace(data)
+	start := strings.HasPrefix(data, deflatePrefix)
+
+	ms.mu.Lock()
+	var entries []manualEntry
+	err := Decode(data, &entries)
+	if err != nil && ms.pending != "" && !start {
+		// maybe the rest of a wrapped blob
+		err = Decode(ms.pending+data, &entries)
+	}
+	if err != nil {
+		if start && ms.pending != "" {
+			ms.screen.Log(fmt.Sprintf("[Manual] new blob, drop %d chars of the previous one", len(ms.pending)))
+			ms.pending = ""
+		}
+		ms.pending += data
+		pending := ms.pending
+		if len(pending) > manualMaxPending {
+			ms.pending = ""
+		}
+		ms.mu.Unlock()
+
+		if len(pending) > manualMaxPending {
+			ms.screen.Log(fmt.Sprintf("[Manual] no blob in %d chars, dropped, paste it again", len(pending)))
+			return
+		}
+		ms.screen.Log(fmt.Sprintf("[Manual] incomplete blob, %d chars so far, paste the rest or /new", len(pending)))
+		return
+	}
+	ms.pending = ""
+	ms.mu.Unlock()
+
+	ms.screen.Log(fmt.Sprintf("[Manual] remote blob, %d messages", len(entries)))
+	for _, entry := range entries {
+		body := ""
+		if len(entry.Data) > 0 {
+			body, err = Encode(entry.Data)
+			if err != nil {
+				ms.screen.Log("[Manual] encode body failed: " + err.Error())
+				continue
+			}
+		}
+		ms.rtc.HandleMessage(manualPeer, protocol.Message{Topic: entry.Topic, Body: body})
+	}
+}
@@ -0,0 +1,320 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"testrtc2/gst"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// mediaCodec is a codec the gst pipelines can encode
+type mediaCodec struct {
+	name        string // as in webrtc + gst, e.g. webrtc.VP8
+	kind        webrtc.RTPCodecType
+	payloadType uint8
+}
+
+var mediaCodecs = map[string]mediaCodec{
+	"vp8":  {webrtc.VP8, webrtc.RTPCodecTypeVideo, webrtc.DefaultPayloadTypeVP8},
+	"vp9":  {webrtc.VP9, webrtc.RTPCodecTypeVideo, webrtc.DefaultPayloadTypeVP9},
+	"h264": {webrtc.H264, webrtc.RTPCodecTypeVideo, webrtc.DefaultPayloadTypeH264},
+	"opus": {webrtc.Opus, webrtc.RTPCodecTypeAudio, webrtc.DefaultPayloadTypeOpus},
+	"g722": {webrtc.G722, webrtc.RTPCodecTypeAudio, webrtc.DefaultPayloadTypeG722},
+	"pcmu": {webrtc.PCMU, webrtc.RTPCodecTypeAudio, webrtc.DefaultPayloadTypePCMU},
+	"pcma": {webrtc.PCMA, webrtc.RTPCodecTypeAudio, webrtc.DefaultPayloadTypePCMA},
+}
+
+// mediaKinds is the order tracks are added in on rebuild
+var mediaKinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+
+// mediaTrack is the local track of one kind fed by a gst pipeline
+type mediaTrack struct {
+	codec  mediaCodec
+	source string
+	track  *webrtc.Track
+	sender *webrtc.RTPSender
+	pipe   *gst.Pipeline // nil when stopped
+}
+
+// lookupCodec finds the codec by name, case insensitive, of the given kind
+func lookupCodec(name string, kind webrtc.RTPCodecType) (mediaCodec, error) {
+	codec, ok := mediaCodecs[strings.ToLower(name)]
+	if !ok || codec.kind != kind {
+		var names []string
+		for _, key := range []string{"vp8", "vp9", "h264", "opus", "g722", "pcmu", "pcma"} {
+			if mediaCodecs[key].kind == kind {
+				names = append(names, key)
+			}
+		}
+		return codec, fmt.Errorf("bad %s codec %s, need one of %s", kind, name, strings.Join(names, ", "))
+	}
+	return codec, nil
+}
+
+// MediaDefaults are the codecs and gstreamer sources of /media
+type MediaDefaults struct {
+	AudioCodec  string `json:"audioCodec"`
+	AudioSource string `json:"audioSource"`
+	VideoCodec  string `json:"videoCodec"`
+	VideoSource string `json:"videoSource"`
+}
+
+func DefaultMedia() MediaDefaults {
+	return MediaDefaults{
+		AudioCodec:  "opus",
+		AudioSource: "audiotestsrc ! audioconvert ! queue",
+		VideoCodec:  "vp8",
+		VideoSource: "videotestsrc pattern=snow ! video/x-raw,width=320,height=240 ! queue",
+	}
+}
+
+// of returns codec and source of the kind
+func (m MediaDefaults) of(kind webrtc.RTPCodecType) (string, string) {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return m.VideoCodec, m.VideoSource
+	}
+	return m.AudioCodec, m.AudioSource
+}
+
+// DataChannelDefaults are the label and options of /data, unset options use pion defaults
+type DataChannelDefaults struct {
+	Label             string  `json:"label"`
+	Ordered           *bool   `json:"ordered,omitempty"`
+	MaxPacketLifeTime *uint16 `json:"maxPacketLifeTime,omitempty"`
+	MaxRetransmits    *uint16 `json:"maxRetransmits,omitempty"`
+	Protocol          *string `json:"protocol,omitempty"`
+}
+
+func DefaultDataChannel() DataChannelDefaults {
+	return DataChannelDefaults{Label: "data"}
+}
+
+// SetMediaDefaults sets codecs and sources of /media
+func (rtc *WebRTC) SetMediaDefaults(media MediaDefaults) error {
+	if _, err := lookupCodec(media.AudioCodec, webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	}
+	if _, err := lookupCodec(media.VideoCodec, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	rtc.mu.Lock()
+	rtc.media = media
+	rtc.mu.Unlock()
+	return nil
+}
+
+// SetDataChannelDefaults sets label and options of /data
+func (rtc *WebRTC) SetDataChannelDefaults(data DataChannelDefaults) error {
+	if data.Label == "" {
+		return fmt.Errorf("data channel label is empty")
+	}
+
+	rtc.mu.Lock()
+	rtc.data = data
+	rtc.mu.Unlock()
+	return nil
+}
+
+func (rtc *WebRTC) mediaDefaults() MediaDefaults {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	return rtc.media
+}
+
+func (rtc *WebRTC) dataChannelDefaults() DataChannelDefaults {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	return rtc.data
+}
+
+// AddMedia handles /media arguments:
+//
+//	(none)                          audio + video of the defaults
+//	audio|video [codec] [source]    one kind, replacing its track
+//
+// codec and source default to those of MediaDefaults, the source is a gst
+// pipeline up to the encoder, e.g. videotestsrc pattern=smpte ! queue
+func (rtc *WebRTC) AddMedia(args string) {
+	fields := strings.Fields(args)
+	defaults := rtc.mediaDefaults()
+	kinds := mediaKinds
+	var codecName, source string
+
+	if len(fields) > 0 {
+		kind := webrtc.NewRTPCodecType(fields[0])
+		if kind == 0 {
+			rtc.screen.Log("[Track] usage: /media [audio|video [codec] [source]]")
+			return
+		}
+		kinds = []webrtc.RTPCodecType{kind}
+		fields = fields[1:]
+
+		// codec is optional, anything else starts the source
+		if len(fields) > 0 {
+			if _, ok := mediaCodecs[strings.ToLower(fields[0])]; ok {
+				codecName = fields[0]
+				fields = fields[1:]
+			}
+		}
+		source = strings.Join(fields, " ")
+	}
+
+	var tracks []mediaTrack
+	for _, kind := range kinds {
+		name, src := defaults.of(kind)
+		if codecName != "" {
+			name = codecName
+		}
+		if source != "" {
+			src = source
+		}
+		codec, err := lookupCodec(name, kind)
+		if err != nil {
+			rtc.screen.Log("[Track] " + err.Error())
+			return
+		}
+		tracks = append(tracks, mediaTrack{codec: codec, source: src})
+	}
+
+	rtc.withTargets(func(p *peer) {
+		p.addMedia(tracks)
+	})
+}
+
+// addMedia adds the tracks, replacing those of the same kind, the other kind
+// keeps its track and pipe. Negotiated peer connections are renegotiated
+func (p *peer) addMedia(tracks []mediaTrack) {
+	p.checkPeer(FeatureMedia)
+
+	for i := range tracks {
+		m := tracks[i] // copy, pipes are per peer
+		kind := m.codec.kind
+		if old := p.media[kind]; old != nil {
+			if old.pipe != nil {
+				old.pipe.Stop()
+				p.screen.Log("[Track] Stop a pipe")
+			}
+			if old.sender != nil {
+				p.screen.Log("[WebRTC] Remove track - " + old.track.Label())
+				p.conn.RemoveTrack(old.sender)
+			}
+			delete(p.media, kind)
+		}
+		if p.startMedia(&m) {
+			p.media[kind] = &m
+		}
+	}
+
+	if p.negotiated() {
+		p.renegotiate()
+	}
+}
+
+// startMedia adds a new track of m to the peer connection and starts its pipeline
+// returns false if the track cannot be added
+func (p *peer) startMedia(m *mediaTrack) bool {
+	kind := m.codec.kind
+	label := "pion1"
+	if kind == webrtc.RTPCodecTypeVideo {
+		label = "pion2"
+	}
+
+	payloadType, err := p.payloadType(m.codec)
+	if err != nil {
+		p.screen.Log(fmt.Sprintf("[WebRTC] create new %s track failed: %s", kind, err))
+		return false
+	}
+	track, err := p.conn.NewTrack(payloadType, rand.Uint32(), kind.String(), label)
+	if err != nil {
+		p.screen.Log(fmt.Sprintf("[WebRTC] create new %s track failed: %s", kind, err))
+		return false
+	}
+	p.screen.Log(fmt.Sprintf("[WebRTC] create new %s track: %s", kind, m.codec.name))
+
+	pipe, err := p.createPipeline(m.codec, track, m.source)
+	if err != nil {
+		p.screen.Log(fmt.Sprintf("[Track] %s pipe failed: %s", kind, err))
+		return false
+	}
+
+	sender, err := p.conn.AddTrack(track)
+	if err != nil {
+		pipe.Stop()
+		p.screen.Log(fmt.Sprintf("[WebRTC] add new %s track failed: %s", kind, err))
+		return false
+	}
+	p.screen.Log(fmt.Sprintf("[WebRTC] add new %s track", kind))
+	m.track = track
+	m.sender = sender
+
+	m.pipe = pipe
+	m.pipe.Start()
+	p.screen.Log(fmt.Sprintf("[Track] %s pipe started: %s", kind, m.source))
+	return true
+}
+
+// Replace handles /replace arguments:
+//
+//	audio|video|label source
+//
+// the new source feeds the track already sent, keeping its SSRC and sender
+// so there is no renegotiation, e.g. /replace video videotestsrc pattern=smpte ! queue
+func (rtc *WebRTC) Replace(args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		rtc.screen.Log("[Track] usage: /replace audio|video|label source")
+		return
+	}
+	name, source := fields[0], strings.Join(fields[1:], " ")
+
+	rtc.withTargets(func(p *peer) {
+		p.replaceSource(name, source)
+	})
+}
+
+// replaceSource restarts the pipeline of the track named by kind or label with source
+func (p *peer) replaceSource(name, source string) {
+	var m *mediaTrack
+	for _, kind := range mediaKinds {
+		t := p.media[kind]
+		if t != nil && t.track != nil && (kind.String() == name || t.track.Label() == name) {
+			m = t
+		}
+	}
+	if m == nil {
+		p.screen.Log(fmt.Sprintf("[Track] %s has no %s track, /media to add one", p.id, name))
+		return
+	}
+
+	// a bad source keeps the old pipe running
+	pipe, err := p.createPipeline(m.codec, m.track, source)
+	if err != nil {
+		p.screen.Log(fmt.Sprintf("[Track] %s %s pipe failed: %s", p.id, m.codec.kind, err))
+		return
+	}
+	if m.pipe != nil {
+		m.pipe.Stop()
+		p.screen.Log("[Track] Stop a pipe")
+	}
+	m.source = source
+	m.pipe = pipe
+	m.pipe.Start()
+	p.screen.Log(fmt.Sprintf("[Track] %s %s source replaced, ssrc %d kept: %s", p.id, m.codec.kind, m.track.SSRC(), m.source))
+}
+
+// createPipeline creates the pipeline of source feeding track, it logs
+// when GStreamer stops it on error or end of stream
+func (p *peer) createPipeline(codec mediaCodec, track *webrtc.Track, source string) (*gst.Pipeline, error) {
+	pipe, err := gst.CreatePipeline(codec.name, []*webrtc.Track{track}, source)
+	if err != nil {
+		return nil, err
+	}
+	pipe.OnEnd(func(reason string) {
+		p.screen.Log(fmt.Sprintf("[Track] %s %s pipe stopped: %s", p.id, codec.kind, reason))
+	})
+	return pipe, nil
+}
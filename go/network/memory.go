@@ -0,0 +1,58 @@
+package network
+
+import (
+	"fmt"
+
+	"testrtc2/protocol"
+	"testrtc2/screen"
+)
+
+// MemorySignal is an in-process Signaling, for two clients in one process
+// Messages are delivered in order to the other end, no server involved
+type MemorySignal struct {
+	screen *screen.Screen
+	rtc    *WebRTC
+	id     string
+	other  *MemorySignal
+	inbox  chan protocol.Message
+}
+
+// NewMemoryPair creates two connected ends with IDs 1 and 2,
+// each logging to its own screen
+func NewMemoryPair(screenA, screenB *screen.Screen) (*MemorySignal, *MemorySignal) {
+	a := &MemorySignal{screen: screenA, id: "1", inbox: make(chan protocol.Message, 256)}
+	b := &MemorySignal{screen: screenB, id: "2", inbox: make(chan protocol.Message, 256)}
+	a.other = b
+	b.other = a
+
+	go a.loopMessage()
+	go b.loopMessage()
+	return a, b
+}
+
+func (ms *MemorySignal) SetWebRTC(rtc *WebRTC) {
+	ms.rtc = rtc
+}
+
+func (ms *MemorySignal) GetID() string {
+	return ms.id
+}
+
+func (ms *MemorySignal) GetPeers() []string {
+	return []string{ms.other.id}
+}
+
+// SendMessage sends msg to the other end, the only peer
+func (ms *MemorySignal) SendMessage(to string, msg protocol.Message) {
+	ms.other.inbox <- msg
+	ms.screen.Log(fmt.Sprintf("[Memory] sent mail to %s: <%s> %d bytes", ms.other.id, msg.Topic, len(msg.Body)))
+}
+
+func (ms *MemorySignal) loopMessage() {
+	for msg := range ms.inbox {
+		ms.screen.Log(fmt.Sprintf("[Memory] got mail from %s: <%s> %d bytes", ms.other.id, msg.Topic, len(msg.Body)))
+		if ms.rtc != nil {
+			ms.rtc.HandleMessage(ms.other.id, msg)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"testrtc2/screen"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// newMemoryClients connects two clients with IDs 1 and 2 through a MemoryPair
+func newMemoryClients() (*WebRTC, *WebRTC) {
+	sa, sb := screen.NewScreen(), screen.NewScreen()
+	ma, mb := NewMemoryPair(sa, sb)
+
+	a, b := NewWebRTC(sa), NewWebRTC(sb)
+	ma.SetWebRTC(a)
+	a.SetSignaling(ma)
+	mb.SetWebRTC(b)
+	b.SetSignaling(mb)
+	return a, b
+}
+
+// waitConnected waits until the peer connection of rtc to id is connected
+func waitConnected(t *testing.T, rtc *WebRTC, id string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var state webrtc.PeerConnectionState
+		rtc.getPeer(id).locked(func(p *peer) {
+			state = p.conn.ConnectionState()
+		})
+		if state == webrtc.PeerConnectionStateConnected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("peer connection to %s not connected", id)
+}
+
+func TestMemoryPair(t *testing.T) {
+	a, b := newMemoryClients()
+	defer a.Reset()
+	defer b.Reset()
+
+	a.CreateDataChannel()
+	a.CreateOffer()
+	waitConnected(t, a, "2")
+	waitConnected(t, b, "1")
+
+	var hello *Hello
+	a.getPeer("2").locked(func(p *peer) {
+		hello = p.remoteHello
+	})
+	if hello == nil || hello.Client != ClientName {
+		t.Errorf("no hello from 2: %+v", hello)
+	}
+}
+
+// TestMemoryPairConcurrent runs commands while signaling and pion callbacks
+// change the same peers, go test -race reports unguarded peer fields
+func TestMemoryPairConcurrent(t *testing.T) {
+	a, b := newMemoryClients()
+	defer a.Reset()
+	defer b.Reset()
+
+	a.CreateDataChannel()
+	a.CreateOffer()
+	waitConnected(t, a, "2")
+
+	var wg sync.WaitGroup
+	setEncoding := func() { a.SetEncoding(EncodingDeflate) }
+	for _, f := range []func(){a.RestartICE, a.LogPeers, a.LogTransceivers, setEncoding, b.LogPeers, b.LogHeldCandidates} {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	wg.Wait()
+
+	waitConnected(t, a, "2")
+	waitConnected(t, b, "1")
+}
@@ -1,25 +1,141 @@
 package network
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 )
 
+// Encoding selects how a message body is packed
+type Encoding int
+
+const (
+	EncodingBase64  Encoding = iota // base64 json, what web + flutter clients speak
+	EncodingJSON                    // plain json
+	EncodingDeflate                 // "z:" + base64 of deflated json
+	EncodingGzip                    // "gz:" + base64 of gzipped json
+)
+
+// markers of zipped forms, ':' is not in the base64 alphabet
+const (
+	deflatePrefix = "z:"
+	gzipPrefix    = "gz:"
+)
+
+var encodingNames = map[Encoding]string{
+	EncodingBase64:  "base64",
+	EncodingJSON:    "json",
+	EncodingDeflate: "deflate",
+	EncodingGzip:    "gzip",
+}
+
+func (e Encoding) String() string {
+	return encodingNames[e]
+}
+
+func ParseEncoding(name string) (Encoding, error) {
+	for e, n := range encodingNames {
+		if n == name {
+			return e, nil
+		}
+	}
+	return EncodingBase64, fmt.Errorf("unknown encoding %s, need base64, json, deflate or gzip", name)
+}
+
 // Encode encodes the input in base64
-// It can optionally zip the input before encoding
+// Use EncodeWith to zip the input before encoding
 func Encode(obj interface{}) (result string, err error) {
+	return EncodeWith(obj, EncodingBase64)
+}
+
+// EncodeWith encodes the input as json, then packs it with the given encoding
+func EncodeWith(obj interface{}, enc Encoding) (result string, err error) {
 	b, err := json.Marshal(obj)
 	if err != nil {
 		return
 	}
-	result = base64.StdEncoding.EncodeToString(b)
+
+	switch enc {
+	case EncodingJSON:
+		result = string(b)
+
+	case EncodingDeflate:
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression) // only fails on bad level
+		err = zip(w, b)
+		result = deflatePrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	case EncodingGzip:
+		var buf bytes.Buffer
+		err = zip(gzip.NewWriter(&buf), b)
+		result = gzipPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	default:
+		result = base64.StdEncoding.EncodeToString(b)
+	}
 	return
 }
 
+func zip(w io.WriteCloser, b []byte) error {
+	_, err := w.Write(b)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// DetectEncoding tells which encoding packed the input, surrounding spaces ignored
+func DetectEncoding(in string) Encoding {
+	trimmed := strings.TrimSpace(in)
+	switch {
+	case strings.HasPrefix(trimmed, deflatePrefix):
+		return EncodingDeflate
+	case strings.HasPrefix(trimmed, gzipPrefix):
+		return EncodingGzip
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		// base64 never starts with these
+		return EncodingJSON
+	}
+	return EncodingBase64
+}
+
 // Decode decodes the input from base64
-// It can optionally unzip the input after decoding
+// It detects and unzips zipped input, plain json is accepted as is
 func Decode(in string, obj interface{}) error {
-	b, err := base64.StdEncoding.DecodeString(in)
+	var b []byte
+	var err error
+
+	in = strings.TrimSpace(in)
+
+	switch DetectEncoding(in) {
+	case EncodingJSON:
+		b = []byte(in)
+
+	case EncodingDeflate:
+		b, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(in, deflatePrefix))
+		if err == nil {
+			b, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+		}
+
+	case EncodingGzip:
+		b, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(in, gzipPrefix))
+		if err == nil {
+			var r *gzip.Reader
+			r, err = gzip.NewReader(bytes.NewReader(b))
+			if err == nil {
+				b, err = ioutil.ReadAll(r)
+			}
+		}
+
+	default:
+		b, err = base64.StdEncoding.DecodeString(in)
+	}
 	if err != nil {
 		return err
 	}
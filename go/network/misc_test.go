@@ -0,0 +1,23 @@
+package network
+
+import "testing"
+
+func TestDecodeTrimmed(t *testing.T) {
+	want := Hello{Client: ClientName, Version: ClientVersion}
+	for _, enc := range []Encoding{EncodingBase64, EncodingJSON, EncodingDeflate, EncodingGzip} {
+		body, err := EncodeWith(want, enc)
+		if err != nil {
+			t.Fatalf("encode %s: %v", enc, err)
+		}
+
+		for _, in := range []string{body, " " + body, "\n" + body + "\n"} {
+			if got := DetectEncoding(in); got != enc {
+				t.Errorf("detect %q: got %s, want %s", in, got, enc)
+			}
+			var got Hello
+			if err := Decode(in, &got); err != nil || got.Client != want.Client || got.Version != want.Version {
+				t.Errorf("decode %q: got %+v, %v", in, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PeerAll selects every known peer as target of commands
+const PeerAll = "all"
+
+// getPeer returns the peer connection to id, creating it on first use
+func (rtc *WebRTC) getPeer(id string) *peer {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	if p := rtc.peers[id]; p != nil {
+		return p
+	}
+
+	p, err := newPeer(rtc, id, rtc.config, rtc.settings)
+	if err != nil {
+		rtc.screen.Log("[WebRTC] create peer connection failed: " + err.Error())
+		return nil
+	}
+	rtc.peers[id] = p
+	return p
+}
+
+func (rtc *WebRTC) allPeers() []*peer {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	peers := []*peer{}
+	for _, p := range rtc.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].id < peers[j].id })
+	return peers
+}
+
+// targets returns the peers a command applies to, the selected one or all
+func (rtc *WebRTC) targets() []*peer {
+	ids := rtc.signal.GetPeers()
+	if len(ids) == 0 {
+		rtc.screen.Log("[System] Need to set peer ID first")
+		return nil
+	}
+
+	peers := []*peer{}
+	for _, id := range ids {
+		if p := rtc.getPeer(id); p != nil {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// withTargets calls f for each target peer, holding it
+func (rtc *WebRTC) withTargets(f func(p *peer)) {
+	for _, p := range rtc.targets() {
+		p.locked(f)
+	}
+}
+
+// withAllPeers calls f for every peer, holding it
+func (rtc *WebRTC) withAllPeers(f func(p *peer)) {
+	for _, p := range rtc.allPeers() {
+		p.locked(f)
+	}
+}
+
+// locked calls f holding p
+func (p *peer) locked(f func(p *peer)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(p)
+}
+
+// PeerIDs returns the IDs of all peer connections, sorted
+func (rtc *WebRTC) PeerIDs() []string {
+	ids := []string{}
+	for _, p := range rtc.allPeers() {
+		ids = append(ids, p.id)
+	}
+	return ids
+}
+
+// ClosePeer closes the peer connection to id, if any
+func (rtc *WebRTC) ClosePeer(id string) {
+	rtc.mu.Lock()
+	p := rtc.peers[id]
+	delete(rtc.peers, id)
+	rtc.mu.Unlock()
+
+	if p != nil {
+		p.locked((*peer).close)
+	}
+}
+
+// LogPeers prints every peer connection with its state
+func (rtc *WebRTC) LogPeers() {
+	rtc.screen.Log(fmt.Sprintf("[WebRTC] %d peer connections", len(rtc.allPeers())))
+	rtc.withAllPeers(func(p *peer) {
+		client := "?"
+		if p.remoteHello != nil {
+			client = p.remoteHello.Client + " " + p.remoteHello.Version
+		}
+		rtc.screen.Log(fmt.Sprintf("  %s: %s, signaling %s, client %s, %s, glare %s", p.id, p.conn.ConnectionState(), p.conn.SignalingState(), client, p.role(), p.glare))
+	})
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"testrtc2/protocol"
+)
+
+// Record is one line of a signaling recording
+type Record struct {
+	Time    time.Time       `json:"time"`
+	Dir     string          `json:"dir"` // in, out
+	Packet  json.RawMessage `json:"packet"`
+	Decoded interface{}     `json:"decoded,omitempty"` // sdp / candidate body, decoded for reading
+}
+
+// Recorder appends every signaling packet to a JSONL file
+type Recorder struct {
+	file *os.File
+	mu   sync.Mutex
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file}, nil
+}
+
+// decodeBody returns the decoded body of sdp / candidate messages, nil otherwise
+func decodeBody(packet []byte) interface{} {
+	var mp struct {
+		Msg protocol.Message `json:"msg"`
+	}
+	if json.Unmarshal(packet, &mp) != nil {
+		return nil
+	}
+
+	switch mp.Msg.Topic {
+	case "sdp", "candidate":
+		var body interface{}
+		if Decode(mp.Msg.Body, &body) != nil {
+			return nil
+		}
+		return body
+	}
+	return nil
+}
+
+func (r *Recorder) Record(dir string, packet []byte) error {
+	rec := Record{time.Now(), dir, json.RawMessage(packet), decodeBody(packet)}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		// not a json packet, keep it as string
+		rec.Packet, _ = json.Marshal(string(packet))
+		line, err = json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// LoadRecords reads a recording made by Recorder
+func LoadRecords(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 65535), 16*1024*1024) // big sdp
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// iceCredentials are the ICE username fragment and password of an sdp
+type iceCredentials struct {
+	ufrag string
+	pwd   string
+}
+
+func parseICECredentials(sdp string) (c iceCredentials) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=ice-ufrag:") && c.ufrag == "" {
+			c.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+		if strings.HasPrefix(line, "a=ice-pwd:") && c.pwd == "" {
+			c.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		}
+	}
+	return
+}
+
+// RestartICE reconnects the target peers, pion v2 has no ICE restart
+func (rtc *WebRTC) RestartICE() {
+	rtc.withTargets((*peer).restartICE)
+}
+
+// restartICE reconnects with a new peer connection and offers it
+// pion v2 refuses the ICERestart option, a fresh peer connection is the only way
+// to new ICE credentials, it also starts a new DTLS session, keeping local data channel + media
+func (p *peer) restartICE() {
+	if p.conn.LocalDescription() == nil {
+		p.screen.Log("[ICE] no local sdp yet, nothing to reconnect")
+		return
+	}
+
+	p.checkPeer(FeatureICERestart)
+
+	p.screen.Log(fmt.Sprintf("[ICE] reconnect to %s, pion v2 has no ICE restart, rebuild peer connection", p.id))
+	p.reconnect()
+}
+
+// reconnect rebuilds the peer connection and offers it, the peer gets
+// new ICE credentials and a new DTLS session
+func (p *peer) reconnect() {
+	var old iceCredentials
+	if local := p.conn.LocalDescription(); local != nil {
+		old = parseICECredentials(local.SDP)
+	}
+
+	err := p.rebuild()
+	if err != nil {
+		p.screen.Log("[WebRTC] rebuild for reconnect failed: " + err.Error())
+		return
+	}
+	p.reconnectAt = time.Now()
+	p.createOffer()
+
+	// held until /setlocal in manual sdp mode
+	offer := p.localDesc
+	if offer == nil {
+		offer = p.conn.LocalDescription()
+	}
+	if offer != nil {
+		creds := parseICECredentials(offer.SDP)
+		p.screen.Log(fmt.Sprintf("[ICE] reconnect offer to %s, ufrag %s -> %s, pwd %s", p.id, old.ufrag, creds.ufrag, creds.pwd))
+	}
+}
+
+// handleRestart checks if the remote offer has new ICE credentials,
+// pion v2 cannot restart ICE of a running connection, so it reconnects
+// with a new one. A browser keeps its DTLS session on restartIce and may fail,
+// /new on both sides then
+// returns false when the offer cannot be applied
+func (p *peer) handleRestart(desc webrtc.SessionDescription) bool {
+	prev := p.conn.RemoteDescription()
+	if prev == nil {
+		return true
+	}
+
+	old := parseICECredentials(prev.SDP)
+	creds := parseICECredentials(desc.SDP)
+	if creds.ufrag == old.ufrag {
+		return true
+	}
+
+	p.screen.Log(fmt.Sprintf("[ICE] %s offers new ICE credentials, ufrag %s -> %s, pwd %s -> %s", p.id, old.ufrag, creds.ufrag, old.pwd, creds.pwd))
+	p.screen.Log("[ICE] pion v2 has no ICE restart, reconnect with a new peer connection")
+	p.reconnectAt = time.Now()
+	err := p.rebuild()
+	if err != nil {
+		p.screen.Log("[ICE] rebuild for reconnect failed: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// logReconnect logs how long the connection took to come back after a reconnect
+func (p *peer) logReconnect(state webrtc.ICEConnectionState) {
+	if p.reconnectAt.IsZero() {
+		return
+	}
+
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		p.screen.Log(fmt.Sprintf("[ICE] %s reconnected in %s", p.id, time.Since(p.reconnectAt).Round(time.Millisecond)))
+	case webrtc.ICEConnectionStateFailed:
+		p.screen.Log(fmt.Sprintf("[ICE] %s reconnect failed after %s", p.id, time.Since(p.reconnectAt).Round(time.Millisecond)))
+	default:
+		return
+	}
+	p.reconnectAt = time.Time{}
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// SetManualSDP stops automatic negotiation, like web client buttons
+// /offer and /answer only create the sdp, /setlocal sets it, /sendsdp sends it,
+// remote sdp is held until /setremote
+func (rtc *WebRTC) SetManualSDP(manual bool) {
+	rtc.mu.Lock()
+	rtc.manualSDP = manual
+	rtc.mu.Unlock()
+
+	if manual {
+		rtc.screen.Log("[SDP] manual mode: /offer or /answer, /setlocal, /sendsdp, /setremote")
+	} else {
+		rtc.screen.Log("[SDP] auto mode, remote offers are answered")
+	}
+}
+
+func (rtc *WebRTC) isManualSDP() bool {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	return rtc.manualSDP
+}
+
+// SetLocal sets the created local sdp of the target peers
+func (rtc *WebRTC) SetLocal() {
+	rtc.withTargets(func(p *peer) {
+		if p.localDesc == nil {
+			rtc.screen.Log("[SDP] no local sdp created for " + p.id)
+			return
+		}
+
+		err := p.conn.SetLocalDescription(*p.localDesc)
+		if err != nil {
+			rtc.screen.Log("[WebRTC] set local sdp failed: " + err.Error())
+			return
+		}
+		rtc.screen.Log(fmt.Sprintf("[WebRTC] local %s set for %s", p.localDesc.Type, p.id))
+		if p.localDesc.Type == webrtc.SDPTypeAnswer {
+			p.logCodecs()
+		}
+		p.localDesc = nil
+	})
+}
+
+// SendSDP sends the current local sdp to the target peers
+func (rtc *WebRTC) SendSDP() {
+	rtc.withTargets(func(p *peer) {
+		desc := p.conn.LocalDescription()
+		if desc == nil {
+			rtc.screen.Log("[SDP] no local sdp set for " + p.id)
+			return
+		}
+		p.sendLocalSDP(*desc)
+	})
+}
+
+// SetRemote applies the held remote sdp of the target peers,
+// kept to experiment with setting it twice
+func (rtc *WebRTC) SetRemote() {
+	for _, p := range rtc.targets() {
+		p.setRemote()
+	}
+}
+
+// setRemote applies the held remote sdp, p is not held while pion sets it:
+// an offer set twice before the answer blocks in pion v2 until the transports
+// started by the first one are connected, or forever when they fail
+func (p *peer) setRemote() {
+	p.mu.Lock()
+	conn, desc := p.conn, p.remoteDesc
+	p.mu.Unlock()
+	if desc == nil {
+		p.screen.Log("[SDP] no remote sdp held from " + p.id)
+		return
+	}
+
+	err := conn.SetRemoteDescription(*desc)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.screen.Log("[WebRTC] set remote sdp failed: " + err.Error())
+		return
+	}
+	if conn != p.conn {
+		p.screen.Log("[WebRTC] remote sdp set on a replaced peer connection to " + p.id)
+		return
+	}
+	p.screen.Log(fmt.Sprintf("[WebRTC] remote %s set from %s", desc.Type, p.id))
+	p.flushCandidates()
+	if desc.Type == webrtc.SDPTypeAnswer {
+		p.isOffering = false
+		p.logCodecs()
+	}
+}
+
+// Rollback drops the pending offer of the target peers,
+// a withdrawn local offer is also rolled back at the peer
+func (rtc *WebRTC) Rollback() {
+	rtc.withTargets(func(p *peer) {
+		local := p.conn.SignalingState() == webrtc.SignalingStateHaveLocalOffer
+		err := p.rollback()
+		if err != nil {
+			rtc.screen.Log("[WebRTC] rollback failed: " + err.Error())
+			return
+		}
+		p.localDesc = nil
+		rtc.screen.Log(fmt.Sprintf("[WebRTC] rolled back, %s signaling -> %s", p.id, p.conn.SignalingState()))
+
+		if local {
+			p.sendLocalSDP(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+		}
+	})
+}
+
+// remoteRollback handles a peer withdrawing its offer
+func (p *peer) remoteRollback() {
+	state := p.conn.SignalingState()
+	if state != webrtc.SignalingStateHaveRemoteOffer {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s rolled back, nothing to do in %s", p.id, state))
+		return
+	}
+
+	err := p.rollback()
+	if err != nil {
+		p.screen.Log("[WebRTC] rollback failed: " + err.Error())
+		return
+	}
+	p.remoteDesc = nil
+	p.screen.Log(fmt.Sprintf("[WebRTC] %s rolled back, signaling -> %s", p.id, p.conn.SignalingState()))
+}
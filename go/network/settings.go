@@ -0,0 +1,298 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var (
+	networkTypes = map[string]webrtc.NetworkType{
+		"udp4": webrtc.NetworkTypeUDP4,
+		"udp6": webrtc.NetworkTypeUDP6,
+	}
+	natTypes = map[string]webrtc.ICECandidateType{
+		"host":  webrtc.ICECandidateTypeHost,
+		"srflx": webrtc.ICECandidateTypeSrflx,
+	}
+)
+
+// Settings are the pion SettingEngine options and codecs of new peer connections
+type Settings struct {
+	PortMin      uint16 // ephemeral UDP ports, 0 for any
+	PortMax      uint16
+	NAT1To1IPs   []string // advertised instead of / in addition to local IPs
+	NAT1To1Type  webrtc.ICECandidateType
+	NetworkTypes []webrtc.NetworkType // nil for all supported
+
+	// pion v2 only knows the silence on the selected pair, it goes disconnected
+	// there is no failed timeout, a connection fails when the selection
+	// timeout passes without any valid pair
+	DisconnectedTimeout time.Duration
+	KeepaliveInterval   time.Duration
+	SelectionTimeout    time.Duration
+
+	// min wait before a pair with this candidate type can be nominated
+	HostWait  time.Duration
+	SrflxWait time.Duration
+	PrflxWait time.Duration
+	RelayWait time.Duration
+
+	Codecs []CodecPreference // in order, nil for pion defaults
+}
+
+// DefaultSettings are the pion defaults
+func DefaultSettings() Settings {
+	return Settings{
+		NAT1To1Type:         webrtc.ICECandidateTypeHost,
+		DisconnectedTimeout: 30 * time.Second,
+		KeepaliveInterval:   10 * time.Second,
+		SelectionTimeout:    10 * time.Second,
+		SrflxWait:           500 * time.Millisecond,
+		PrflxWait:           time.Second,
+		RelayWait:           2 * time.Second,
+	}
+}
+
+// ParsePortRange parses min-max, empty or any for no limit
+func ParsePortRange(spec string) (uint16, uint16, error) {
+	if spec == "" || spec == "any" {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("bad port range %s, need min-max", spec)
+	}
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port range %s, need min-max", spec)
+	}
+	max, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad port range %s, need min-max", spec)
+	}
+	if min == 0 || max < min {
+		return 0, 0, fmt.Errorf("bad port range %s, need 0 < min <= max", spec)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// ParseNATIPs parses comma separated external IPs of a 1:1 NAT
+func ParseNATIPs(spec string) ([]string, error) {
+	ips := strings.Split(spec, ",")
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("bad NAT 1:1 IP %s", ip)
+		}
+	}
+	return ips, nil
+}
+
+// ParseNATType parses the candidate type of NAT 1:1 IPs, host or srflx
+func ParseNATType(name string) (webrtc.ICECandidateType, error) {
+	t, ok := natTypes[name]
+	if !ok {
+		return t, fmt.Errorf("bad NAT 1:1 candidate type %s, need host or srflx", name)
+	}
+	return t, nil
+}
+
+// ParseNetworkTypes parses comma separated network types, empty or all for all supported
+func ParseNetworkTypes(spec string) ([]webrtc.NetworkType, error) {
+	if spec == "" || spec == "all" {
+		return nil, nil
+	}
+
+	var types []webrtc.NetworkType
+	for _, name := range strings.Split(spec, ",") {
+		t, ok := networkTypes[name]
+		if !ok {
+			if strings.HasPrefix(name, "tcp") {
+				return nil, fmt.Errorf("network type %s not supported, pion v2 only gathers udp candidates", name)
+			}
+			return nil, fmt.Errorf("bad network type %s, need udp4 or udp6", name)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// SetTimeout sets a timeout by name: disconnected, failed, keepalive or selection
+// failed is the selection timeout, see Settings
+func (s *Settings) SetTimeout(name string, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative %s timeout", name)
+	}
+
+	switch name {
+	case "disconnected":
+		s.DisconnectedTimeout = d
+	case "keepalive":
+		s.KeepaliveInterval = d
+	case "selection", "failed":
+		s.SelectionTimeout = d
+	default:
+		return fmt.Errorf("bad timeout %s, need disconnected, failed, keepalive or selection", name)
+	}
+	return nil
+}
+
+// SetWait sets the acceptance min wait of a candidate type: host, srflx, prflx or relay
+func (s *Settings) SetWait(name string, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative %s wait", name)
+	}
+
+	switch name {
+	case "host":
+		s.HostWait = d
+	case "srflx":
+		s.SrflxWait = d
+	case "prflx":
+		s.PrflxWait = d
+	case "relay":
+		s.RelayWait = d
+	default:
+		return fmt.Errorf("bad candidate type %s, need host, srflx, prflx or relay", name)
+	}
+	return nil
+}
+
+// SetSettings sets the SettingEngine options of new peer connections
+func (rtc *WebRTC) SetSettings(settings Settings) error {
+	if settings.PortMax < settings.PortMin {
+		return fmt.Errorf("bad port range %d-%d", settings.PortMin, settings.PortMax)
+	}
+
+	rtc.mu.Lock()
+	rtc.settings = settings
+	rtc.mu.Unlock()
+	return nil
+}
+
+func (rtc *WebRTC) getSettings() Settings {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	settings := rtc.settings
+	settings.NAT1To1IPs = append([]string{}, settings.NAT1To1IPs...)
+	settings.NetworkTypes = append([]webrtc.NetworkType{}, settings.NetworkTypes...)
+	settings.Codecs = append([]CodecPreference(nil), settings.Codecs...)
+	return settings
+}
+
+// newAPI makes the pion API of a new peer connection
+func newAPI(settings Settings) (*webrtc.API, error) {
+	se := webrtc.SettingEngine{}
+	if settings.PortMax != 0 {
+		err := se.SetEphemeralUDPPortRange(settings.PortMin, settings.PortMax)
+		if err != nil {
+			return nil, fmt.Errorf("udp ports %d-%d: %v", settings.PortMin, settings.PortMax, err)
+		}
+	}
+	if len(settings.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(settings.NAT1To1IPs, settings.NAT1To1Type)
+	}
+	if len(settings.NetworkTypes) > 0 {
+		se.SetNetworkTypes(settings.NetworkTypes)
+	}
+	se.SetConnectionTimeout(settings.DisconnectedTimeout, settings.KeepaliveInterval)
+	se.SetCandidateSelectionTimeout(settings.SelectionTimeout)
+	se.SetHostAcceptanceMinWait(settings.HostWait)
+	se.SetSrflxAcceptanceMinWait(settings.SrflxWait)
+	se.SetPrflxAcceptanceMinWait(settings.PrflxWait)
+	se.SetRelayAcceptanceMinWait(settings.RelayWait)
+
+	m := webrtc.MediaEngine{}
+	registerCodecs(&m, settings.Codecs)
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se)), nil
+}
+
+// configureSettings handles the /config arguments of settings:
+//
+//	ports min-max|any
+//	nat ip[,ip] host|srflx
+//	nat off
+//	network udp4[,udp6]|all
+//	timeout disconnected|failed|keepalive|selection duration
+//	wait host|srflx|prflx|relay duration
+//
+// returns false if fields are not a setting
+func (rtc *WebRTC) configureSettings(fields []string) (bool, error) {
+	settings := rtc.getSettings()
+	var err error
+
+	switch {
+	case fields[0] == "ports" && len(fields) == 2:
+		settings.PortMin, settings.PortMax, err = ParsePortRange(fields[1])
+
+	case fields[0] == "nat" && len(fields) == 2 && fields[1] == "off":
+		settings.NAT1To1IPs = nil
+
+	case fields[0] == "nat" && len(fields) == 3:
+		settings.NAT1To1IPs, err = ParseNATIPs(fields[1])
+		if err == nil {
+			settings.NAT1To1Type, err = ParseNATType(fields[2])
+		}
+
+	case fields[0] == "network" && len(fields) == 2:
+		settings.NetworkTypes, err = ParseNetworkTypes(fields[1])
+
+	case fields[0] == "timeout" && len(fields) == 3:
+		var d time.Duration
+		d, err = time.ParseDuration(fields[2])
+		if err == nil {
+			err = settings.SetTimeout(fields[1], d)
+		}
+
+	case fields[0] == "wait" && len(fields) == 3:
+		var d time.Duration
+		d, err = time.ParseDuration(fields[2])
+		if err == nil {
+			err = settings.SetWait(fields[1], d)
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		return true, err
+	}
+	return true, rtc.SetSettings(settings)
+}
+
+// showSettings prints the SettingEngine options of new peer connections
+func (rtc *WebRTC) showSettings() {
+	settings := rtc.getSettings()
+
+	ports := "any"
+	if settings.PortMax != 0 {
+		ports = fmt.Sprintf("%d-%d", settings.PortMin, settings.PortMax)
+	}
+	nat := "off"
+	if len(settings.NAT1To1IPs) > 0 {
+		nat = strings.Join(settings.NAT1To1IPs, ",") + " as " + settings.NAT1To1Type.String()
+	}
+	types := "all"
+	if len(settings.NetworkTypes) > 0 {
+		var names []string
+		for _, t := range settings.NetworkTypes {
+			names = append(names, t.String())
+		}
+		types = strings.Join(names, ",")
+	}
+
+	rtc.screen.Log(fmt.Sprintf("[Config] udp ports %s, nat 1:1 %s, network %s", ports, nat, types))
+	rtc.screen.Log(fmt.Sprintf("[Config] timeout disconnected %s, keepalive %s, selection (failed) %s",
+		settings.DisconnectedTimeout, settings.KeepaliveInterval, settings.SelectionTimeout))
+	rtc.screen.Log(fmt.Sprintf("[Config] wait host %s, srflx %s, prflx %s, relay %s",
+		settings.HostWait, settings.SrflxWait, settings.PrflxWait, settings.RelayWait))
+	if _, err := newAPI(settings); err != nil {
+		rtc.screen.Log("[Config] bad settings, new peer connections fail: " + err.Error())
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"errors"
+
+	"testrtc2/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Signaling carries messages between WebRTC and remote peers
+type Signaling interface {
+	// GetID returns our own ID, empty when unknown
+	GetID() string
+	// GetPeers returns the peers commands apply to, the selected one or all
+	GetPeers() []string
+	SendMessage(to string, msg protocol.Message)
+}
+
+// packetConn is one connection to the signal server, carrying JSON packets
+type packetConn interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(data []byte) error
+	Close() error
+}
+
+// errRejected means the server refused us, reconnecting will not help
+var errRejected = errors.New("rejected by server")
+
+// wsConn is a packetConn over websocket
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func (c *wsConn) ReadPacket() ([]byte, error) {
+	_, message, err := c.conn.ReadMessage()
+	if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		return nil, errRejected
+	}
+	return message, err
+}
+
+func (c *wsConn) WritePacket(data []byte) error {
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// LoadTLSConfig builds the client TLS config for wss:// signal servers
+// caFile adds a CA bundle to trust, certFile + keyFile present a client certificate
+func LoadTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// ParseSignalURL accepts a full ws:// wss:// URL, http:// https:// for long-poll,
+// or a bare host:port which means ws://host:port/ as before
+func ParseSignalURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "ws://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s, need ws, wss, http or https", u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
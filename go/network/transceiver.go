@@ -0,0 +1,399 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var transceiverDirections = map[string]webrtc.RTPTransceiverDirection{
+	"sendrecv": webrtc.RTPTransceiverDirectionSendrecv,
+	"sendonly": webrtc.RTPTransceiverDirectionSendonly,
+	"recvonly": webrtc.RTPTransceiverDirectionRecvonly,
+	"inactive": webrtc.RTPTransceiverDirectionInactive,
+}
+
+// transceiverSpec is a transceiver added by /transceiver, restored on rebuild
+type transceiverSpec struct {
+	kind      webrtc.RTPCodecType
+	direction webrtc.RTPTransceiverDirection
+	t         *webrtc.RTPTransceiver // of the current peer connection
+}
+
+// sdpMedia is one m= section of an sdp
+type sdpMedia struct {
+	kind      string
+	mid       string
+	direction string
+	formats   []string          // payload types in order of preference
+	rtpmap    map[string]string // by payload type, e.g. opus/48000/2
+	fmtp      map[string]string // by payload type
+}
+
+func parseMediaSections(sdp string) (sections []sdpMedia) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			// m=audio 9 UDP/TLS/RTP/SAVPF 111 0 8
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			m := sdpMedia{rtpmap: make(map[string]string), fmtp: make(map[string]string)}
+			if len(fields) > 0 {
+				m.kind = fields[0]
+			}
+			if len(fields) > 3 {
+				m.formats = fields[3:]
+			}
+			sections = append(sections, m)
+		case len(sections) == 0:
+		case strings.HasPrefix(line, "a=mid:"):
+			sections[len(sections)-1].mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=rtpmap:"), strings.HasPrefix(line, "a=fmtp:"):
+			kv := strings.SplitN(line[2:], " ", 2)
+			pt := strings.SplitN(kv[0], ":", 2)
+			if len(kv) == 2 && len(pt) == 2 && pt[0] == "rtpmap" {
+				sections[len(sections)-1].rtpmap[pt[1]] = kv[1]
+			} else if len(kv) == 2 && len(pt) == 2 {
+				sections[len(sections)-1].fmtp[pt[1]] = kv[1]
+			}
+		case transceiverDirections[strings.TrimPrefix(line, "a=")] != 0:
+			sections[len(sections)-1].direction = strings.TrimPrefix(line, "a=")
+		}
+	}
+	return
+}
+
+// reverseDirection is the direction seen from the other side
+func reverseDirection(direction string) string {
+	switch direction {
+	case "sendonly":
+		return "recvonly"
+	case "recvonly":
+		return "sendonly"
+	}
+	return direction
+}
+
+// Transceiver handles /transceiver arguments:
+//
+//	audio|video sendrecv|sendonly|recvonly|inactive   add a transceiver
+//	n sendrecv|sendonly|recvonly|inactive             change direction of the nth of /transceivers
+//
+// negotiated peer connections are renegotiated
+func (rtc *WebRTC) Transceiver(args string) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		rtc.screen.Log("[Transceiver] usage: /transceiver audio|video|n sendrecv|sendonly|recvonly|inactive")
+		return
+	}
+	direction, ok := transceiverDirections[fields[1]]
+	if !ok {
+		rtc.screen.Log("[Transceiver] bad direction " + fields[1] + ", need sendrecv, sendonly, recvonly or inactive")
+		return
+	}
+
+	if index, err := strconv.Atoi(fields[0]); err == nil {
+		rtc.withTargets(func(p *peer) {
+			p.setTransceiverDirection(index, direction)
+		})
+		return
+	}
+
+	kind := webrtc.NewRTPCodecType(fields[0])
+	if kind == 0 {
+		rtc.screen.Log("[Transceiver] bad kind " + fields[0] + ", need audio or video")
+		return
+	}
+	rtc.withTargets(func(p *peer) {
+		p.addTransceiver(&transceiverSpec{kind: kind, direction: direction})
+	})
+}
+
+// LogTransceivers prints the transceivers of the target peers
+func (rtc *WebRTC) LogTransceivers() {
+	rtc.withTargets((*peer).logTransceivers)
+}
+
+func (p *peer) addTransceiver(spec *transceiverSpec) {
+	p.checkPeer(FeatureMedia)
+
+	err := p.createTransceiver(spec)
+	if err != nil {
+		p.screen.Log(fmt.Sprintf("[Transceiver] add %s %s for %s failed: %s", spec.kind, spec.direction, p.id, err))
+		return
+	}
+	p.transceivers = append(p.transceivers, spec)
+
+	if p.negotiated() {
+		p.screen.Log(fmt.Sprintf("[Transceiver] add %s %s for %s", spec.kind, spec.direction, p.id))
+		p.renegotiate()
+		return
+	}
+	p.screen.Log(fmt.Sprintf("[Transceiver] add %s %s for %s, /offer to negotiate", spec.kind, spec.direction, p.id))
+}
+
+// createTransceiver adds the pion transceiver of spec
+// pion v2 creates sendonly ones from a track only and no inactive ones,
+// a sending transceiver gets an idle track, inactive is sendonly with the track removed
+func (p *peer) createTransceiver(spec *transceiverSpec) error {
+	if spec.direction == webrtc.RTPTransceiverDirectionRecvonly {
+		t, err := p.conn.AddTransceiverFromKind(spec.kind, webrtc.RtpTransceiverInit{Direction: spec.direction})
+		spec.t = t
+		return err
+	}
+
+	// idle track of the preferred codec
+	codecs := p.conn.GetRegisteredRTPCodecs(spec.kind)
+	if len(codecs) == 0 {
+		return fmt.Errorf("no %s codecs", spec.kind)
+	}
+	track, err := p.conn.NewTrack(codecs[0].PayloadType, rand.Uint32(), spec.kind.String(), "transceiver")
+	if err != nil {
+		return err
+	}
+
+	direction := spec.direction
+	if direction == webrtc.RTPTransceiverDirectionInactive {
+		direction = webrtc.RTPTransceiverDirectionSendonly
+	}
+	t, err := p.conn.AddTransceiverFromTrack(track, webrtc.RtpTransceiverInit{Direction: direction})
+	if err != nil {
+		return err
+	}
+	spec.t = t
+	if spec.direction == webrtc.RTPTransceiverDirectionInactive {
+		return p.conn.RemoveTrack(t.Sender())
+	}
+	return nil
+}
+
+// setTransceiverDirection changes the direction of the nth transceiver
+// pion v2 has no setDirection, it only stops sending on a running transceiver by
+// removing its track, that is done on the running peer connection and renegotiated.
+// Other changes rebuild the peer connection, a negotiated one is a reconnect
+// with new ICE + DTLS sessions
+func (p *peer) setTransceiverDirection(index int, direction webrtc.RTPTransceiverDirection) {
+	transceivers := p.conn.GetTransceivers()
+	if index < 0 || index >= len(transceivers) {
+		p.screen.Log(fmt.Sprintf("[Transceiver] %s has no transceiver %d", p.id, index))
+		return
+	}
+
+	// only those of /transceiver can be rebuilt with another direction
+	spec := p.transceiverSpec(transceivers[index])
+	if spec == nil {
+		p.screen.Log(fmt.Sprintf("[Transceiver] transceiver %d of %s is not from /transceiver", index, p.id))
+		return
+	}
+	if transceivers[index].Direction() == direction {
+		p.screen.Log(fmt.Sprintf("[Transceiver] transceiver %d of %s is already %s", index, p.id, direction))
+		return
+	}
+
+	t := transceivers[index]
+	old := t.Direction()
+	if t.Sender() != nil && direction == stopSending(old) {
+		err := p.conn.RemoveTrack(t.Sender())
+		if err != nil {
+			p.screen.Log(fmt.Sprintf("[Transceiver] %s transceiver %d: %s -> %s failed: %s", p.id, index, old, direction, err))
+			return
+		}
+		spec.direction = direction
+		if p.negotiated() {
+			p.screen.Log(fmt.Sprintf("[Transceiver] %s transceiver %d: %s -> %s", p.id, index, old, direction))
+			p.renegotiate()
+			return
+		}
+		p.screen.Log(fmt.Sprintf("[Transceiver] %s transceiver %d: %s -> %s, /offer to negotiate", p.id, index, old, direction))
+		return
+	}
+
+	spec.direction = direction
+	if p.negotiated() {
+		p.screen.Log(fmt.Sprintf("[Transceiver] %s transceiver %d: %s -> %s, pion v2 only stops sending on a running transceiver, reconnect with a new peer connection",
+			p.id, index, old, direction))
+		p.reconnect()
+		return
+	}
+
+	p.screen.Log(fmt.Sprintf("[Transceiver] %s transceiver %d: %s -> %s, rebuild peer connection, /offer to negotiate",
+		p.id, index, old, direction))
+	err := p.rebuild()
+	if err != nil {
+		p.screen.Log("[Transceiver] rebuild failed: " + err.Error())
+	}
+}
+
+// stopSending is direction without sending, 0 when it does not send
+func stopSending(direction webrtc.RTPTransceiverDirection) webrtc.RTPTransceiverDirection {
+	switch direction {
+	case webrtc.RTPTransceiverDirectionSendrecv:
+		return webrtc.RTPTransceiverDirectionRecvonly
+	case webrtc.RTPTransceiverDirectionSendonly:
+		return webrtc.RTPTransceiverDirectionInactive
+	}
+	return webrtc.RTPTransceiverDirection(0)
+}
+
+// renegotiate offers added transceivers or media on the running peer connection,
+// pion v2 renegotiates when a remote sdp is set again
+func (p *peer) renegotiate() {
+	p.screen.Log("[WebRTC] renegotiate with " + p.id)
+	p.createOffer()
+}
+
+// transceiverSpec returns the spec of a transceiver added by /transceiver, or nil
+func (p *peer) transceiverSpec(t *webrtc.RTPTransceiver) *transceiverSpec {
+	for _, spec := range p.transceivers {
+		if spec.t == t {
+			return spec
+		}
+	}
+	return nil
+}
+
+// transceiverKind is the kind of the sender or receiver track,
+// pion v2 does not tell it for transceivers without tracks
+func (p *peer) transceiverKind(t *webrtc.RTPTransceiver) webrtc.RTPCodecType {
+	if t.Sender() != nil && t.Sender().Track() != nil {
+		return t.Sender().Track().Kind()
+	}
+	if t.Receiver() != nil && t.Receiver().Track() != nil {
+		return t.Receiver().Track().Kind()
+	}
+	if spec := p.transceiverSpec(t); spec != nil {
+		return spec.kind
+	}
+	return webrtc.RTPCodecType(0)
+}
+
+func (p *peer) logTransceivers() {
+	transceivers := p.conn.GetTransceivers()
+	p.screen.Log(fmt.Sprintf("[Transceiver] %d transceivers of %s", len(transceivers), p.id))
+
+	mids := p.transceiverMids(transceivers)
+	for i, t := range transceivers {
+		sender, receiver := "-", "-"
+		if t.Sender() != nil {
+			sender = trackInfo(t.Sender().Track())
+		}
+		if t.Receiver() != nil {
+			receiver = trackInfo(t.Receiver().Track())
+		}
+
+		mid, current := "-", "-"
+		if mids[i].mid != "" {
+			mid = mids[i].mid
+		}
+		if mids[i].direction != "" {
+			current = mids[i].direction
+		}
+		p.screen.Log(fmt.Sprintf("  %d: %s mid %s, direction %s, current %s, sender %s, receiver %s",
+			i, p.transceiverKind(t), mid, t.Direction(), current, sender, receiver))
+	}
+}
+
+// trackInfo is id, codec and ssrc of a track,
+// the codec of a remote track is known after its first packet
+func trackInfo(track *webrtc.Track) string {
+	if track == nil {
+		return "-"
+	}
+	codec := "?"
+	if track.Codec() != nil {
+		codec = track.Codec().Name
+	}
+	return fmt.Sprintf("%s %s ssrc %d", track.ID(), codec, track.SSRC())
+}
+
+// transceiverMids finds the m= section of each transceiver in the local sdp,
+// with the negotiated direction once stable. pion v2 tells neither,
+// it offers transceivers in order, and answers the first one of the kind
+// whose direction matches the remote offer best
+func (p *peer) transceiverMids(transceivers []*webrtc.RTPTransceiver) []sdpMedia {
+	mids := make([]sdpMedia, len(transceivers))
+	local := p.conn.LocalDescription()
+	if local == nil {
+		return mids
+	}
+
+	var media []sdpMedia
+	for _, m := range parseMediaSections(local.SDP) {
+		if m.kind != "application" {
+			media = append(media, m)
+		}
+	}
+
+	if local.Type == webrtc.SDPTypeAnswer {
+		remote := p.conn.RemoteDescription()
+		if remote == nil {
+			return mids
+		}
+		matched := make([]bool, len(transceivers))
+		for _, m := range parseMediaSections(remote.SDP) {
+			if m.kind == "application" {
+				continue
+			}
+			if i := p.matchTransceiver(transceivers, matched, m); i >= 0 {
+				matched[i] = true
+				mids[i].mid = m.mid
+			}
+		}
+	} else {
+		for i := range transceivers {
+			if i < len(media) {
+				mids[i].mid = media[i].mid
+			}
+		}
+	}
+
+	if p.conn.SignalingState() != webrtc.SignalingStateStable {
+		return mids
+	}
+
+	// negotiated direction: of the local answer, or the remote answer reversed
+	var answer []sdpMedia
+	reverse := local.Type != webrtc.SDPTypeAnswer
+	if reverse {
+		if remote := p.conn.RemoteDescription(); remote != nil {
+			answer = parseMediaSections(remote.SDP)
+		}
+	} else {
+		answer = media
+	}
+	for i := range mids {
+		for _, m := range answer {
+			if mids[i].mid == "" || m.mid != mids[i].mid {
+				continue
+			}
+			mids[i].direction = m.direction
+			if reverse {
+				mids[i].direction = reverseDirection(m.direction)
+			}
+		}
+	}
+	return mids
+}
+
+// matchTransceiver is how pion v2 picks the transceiver answering m, -1 for none
+func (p *peer) matchTransceiver(transceivers []*webrtc.RTPTransceiver, matched []bool, m sdpMedia) int {
+	var preferred []webrtc.RTPTransceiverDirection
+	switch m.direction {
+	case "sendrecv", "sendonly":
+		preferred = []webrtc.RTPTransceiverDirection{webrtc.RTPTransceiverDirectionRecvonly, webrtc.RTPTransceiverDirectionSendrecv}
+	case "recvonly":
+		preferred = []webrtc.RTPTransceiverDirection{webrtc.RTPTransceiverDirectionSendonly, webrtc.RTPTransceiverDirectionSendrecv}
+	}
+
+	for _, direction := range preferred {
+		for i, t := range transceivers {
+			if !matched[i] && p.transceiverKind(t) == webrtc.NewRTPCodecType(m.kind) && t.Direction() == direction {
+				return i
+			}
+		}
+	}
+	return -1
+}
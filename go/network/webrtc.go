@@ -2,70 +2,204 @@ package network
 
 import (
 	"fmt"
-	"math/rand"
+	"sync"
+	"time"
 
-	"testrtc2/gst"
+	"testrtc2/protocol"
 	"testrtc2/screen"
 
 	"github.com/pion/webrtc/v2"
 )
 
+// WebRTC keeps one peer connection per remote peer ID
 type WebRTC struct {
-	screen     *screen.Screen
-	ws         *WebSocket
-	conn       *webrtc.PeerConnection
-	isOffering bool
-	isPeered   bool
-	pipes      []*gst.Pipeline
+	screen    *screen.Screen
+	signal    Signaling
+	peers     map[string]*peer
+	encoding  Encoding             // of outgoing sdp + candidates
+	manualSDP bool                 // hold sdp until /setlocal, /sendsdp, /setremote
+	config    webrtc.Configuration // of new peer connections
+	media     MediaDefaults        // of /media
+	data      DataChannelDefaults  // of /data
+	settings  Settings             // of new peer connections
+	mu        sync.Mutex           // guards peers + encoding + manualSDP + config + defaults + settings
+
+	manualICE bool // hold candidates until /sendice, /addice
+	iceFilter CandidateFilter
+	iceMu     sync.Mutex // guards held candidates + filter
+}
+
+// peer is the peer connection to one remote peer
+// commands, signaling and pion callbacks change it from their own goroutines,
+// each holds mu while doing so, see locked
+type peer struct {
+	rtc         *WebRTC
+	screen      *screen.Screen
+	id          string
+	mu          sync.Mutex
+	conn        *webrtc.PeerConnection
+	connMu      sync.Mutex // guards conn too, for OnICECandidate, see current
+	isOffering  bool
+	isPeered    bool
+	ignoreOffer bool // impolite, colliding remote offer ignored
+	hasData     bool // local data channel, restored on rebuild
+	glare       glareCounter
+	reconnectAt time.Time // reconnect in progress since
+	greeted     bool      // hello sent
+	remoteHello *Hello    // nil until peer says hello
+
+	media        map[webrtc.RTPCodecType]*mediaTrack // added by /media, restored on rebuild
+	transceivers []*transceiverSpec                  // added by /transceiver, restored on rebuild
+
+	localDesc  *webrtc.SessionDescription // created, not set yet in manual sdp mode
+	remoteDesc *webrtc.SessionDescription // held in manual sdp mode
+
+	earlyCandidates []webrtc.ICECandidateInit // remote, before remote sdp
+	iceCounter      iceCounter
+
+	localCandidates  []webrtc.ICECandidateInit // held in manual ICE mode
+	remoteCandidates []webrtc.ICECandidateInit
 }
 
 func NewWebRTC(screen *screen.Screen) *WebRTC {
-	return &WebRTC{screen, nil, nil, false, false, nil}
+	return &WebRTC{
+		screen:   screen,
+		peers:    make(map[string]*peer),
+		config:   DefaultConfiguration(),
+		media:    DefaultMedia(),
+		data:     DefaultDataChannel(),
+		settings: DefaultSettings(),
+	}
 }
 
-func (rtc *WebRTC) SetWebSocket(ws *WebSocket) {
-	rtc.ws = ws
+// SetEncoding sets how outgoing sdp + candidates are packed
+// web + flutter clients only understand EncodingBase64
+func (rtc *WebRTC) SetEncoding(enc Encoding) {
+	rtc.mu.Lock()
+	rtc.encoding = enc
+	rtc.mu.Unlock()
+	rtc.screen.Log("[System] Set encoding: " + enc.String())
+	if enc != EncodingBase64 {
+		rtc.withAllPeers(func(p *peer) {
+			p.checkPeer("encoding:" + enc.String())
+		})
+	}
 }
 
-func (rtc *WebRTC) StopPipe() {
-	// stop pipe
-	for _, pipe := range rtc.pipes {
-		pipe.Stop()
-		rtc.screen.Log("[Track] Stop a pipe")
+func (rtc *WebRTC) getEncoding() Encoding {
+	rtc.mu.Lock()
+	defer rtc.mu.Unlock()
+	return rtc.encoding
+}
+
+func (rtc *WebRTC) SetSignaling(signal Signaling) {
+	rtc.signal = signal
+}
+
+// HandleMessage handles a message from the remote peer `from`
+func (rtc *WebRTC) HandleMessage(from string, msg protocol.Message) {
+	p := rtc.getPeer(from)
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.greeted {
+		// first mail from this peer
+		p.sendHello()
+	}
+
+	switch msg.Topic {
+	case "ping":
+		p.send(protocol.Message{Topic: "pong"})
+
+	case "pong":
+		// reply of ping, logged by signaling
+
+	case "sdp":
+		p.setRemoteSDP(msg.Body)
+
+	case "candidate":
+		p.setCandidate(msg.Body)
+
+	case "hello":
+		p.handleHello(msg.Body)
+
+	default:
+		rtc.screen.Log(fmt.Sprintf("[WebRTC] unknown topic <%s> from %s, ignored", msg.Topic, from))
 	}
-	rtc.pipes = nil
 }
 
+// Reset closes all peer connections
 func (rtc *WebRTC) Reset() {
-	rtc.StopPipe()
-	rtc.isOffering = false
-	rtc.isPeered = false
-
-	if rtc.conn != nil {
-		rtc.conn.Close()
-		rtc.screen.Log("[System] Close previous peer connection")
-		rtc.conn = nil
+	rtc.mu.Lock()
+	peers := rtc.peers
+	rtc.peers = make(map[string]*peer)
+	rtc.mu.Unlock()
+
+	for _, p := range peers {
+		p.locked((*peer).close)
+	}
+}
+
+// Init starts over, peer connections are created per remote peer on first use
+func (rtc *WebRTC) Init() {
+	rtc.Reset()
+	rtc.screen.Log("[WebRTC] ready for peers")
+}
+
+func (rtc *WebRTC) CreateDataChannel() {
+	rtc.withTargets((*peer).createDataChannel)
+}
+
+func (rtc *WebRTC) CreateOffer() {
+	rtc.withTargets((*peer).createOffer)
+}
+
+func (rtc *WebRTC) CreateAnswer() {
+	rtc.withTargets((*peer).createAnswer)
+}
+
+func (p *peer) send(msg protocol.Message) {
+	p.rtc.signal.SendMessage(p.id, msg)
+}
+
+func (p *peer) stopPipe() {
+	// stop pipe
+	for _, m := range p.media {
+		if m.pipe != nil {
+			m.pipe.Stop()
+			m.pipe = nil
+			p.screen.Log("[Track] Stop a pipe")
+		}
 	}
 }
 
-func (rtc *WebRTC) registerDataCallback(channel *webrtc.DataChannel) {
+func (p *peer) close() {
+	p.stopPipe()
+	p.dropCandidates()
+	p.conn.Close()
+	p.screen.Log("[System] Close peer connection to " + p.id)
+}
+
+func (p *peer) registerDataCallback(channel *webrtc.DataChannel) {
 	channel.OnOpen(func() {
-		rtc.screen.Log("[DataChannel] OnOpen")
+		p.screen.Log("[DataChannel] OnOpen")
 		channel.SendText("ping")
 	})
 
 	channel.OnError(func(err error) {
-		rtc.screen.Log("[DataChannel] OnError: " + err.Error())
+		p.screen.Log("[DataChannel] OnError: " + err.Error())
 	})
 
 	channel.OnClose(func() {
-		rtc.screen.Log("[DataChannel] OnClose")
+		p.screen.Log("[DataChannel] OnClose")
 	})
 
 	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
 		if msg.IsString {
 			st := string(msg.Data)
-			rtc.screen.Log("[DataChannel] OnMessage: " + st)
+			p.screen.Log(fmt.Sprintf("[DataChannel] OnMessage from %s: %s", p.id, st))
 			if st == "ping" {
 				channel.SendText("pong")
 			}
@@ -74,249 +208,235 @@ func (rtc *WebRTC) registerDataCallback(channel *webrtc.DataChannel) {
 		}
 	})
 
-	rtc.screen.Log("[DataChannel] Register callbacks")
+	p.screen.Log("[DataChannel] Register callbacks")
 }
 
-func (rtc *WebRTC) CreateDataChannel() {
-	if rtc.conn == nil {
-		rtc.screen.Log("[System] No peer connection to create data channel")
-		return
-	}
+func (p *peer) createDataChannel() {
+	p.checkPeer(FeatureDataChannel)
 
 	// DataChannel
-	channel, err := rtc.conn.CreateDataChannel("data", nil)
+	data := p.rtc.dataChannelDefaults()
+	channel, err := p.conn.CreateDataChannel(data.Label, &webrtc.DataChannelInit{
+		Ordered:           data.Ordered,
+		MaxPacketLifeTime: data.MaxPacketLifeTime,
+		MaxRetransmits:    data.MaxRetransmits,
+		Protocol:          data.Protocol,
+	})
 	if err != nil {
-		rtc.screen.Log("[WebRTC] create data channel failed: " + err.Error())
+		p.screen.Log("[WebRTC] create data channel failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] Create Data Channel")
+	p.screen.Log("[WebRTC] Create Data Channel to " + p.id)
+	p.hasData = true
 
-	rtc.registerDataCallback(channel)
+	p.registerDataCallback(channel)
 }
 
-func (rtc *WebRTC) AddMedia() {
-	if rtc.conn == nil {
-		rtc.screen.Log("[System] No peer connection to add media")
-		return
-	}
-
-	// stop pipelines
-	rtc.StopPipe()
+func (p *peer) createOffer() {
+	p.checkPeer(FeatureAnswer)
+	p.isOffering = true
 
-	// remove all media sender
-	for _, sender := range rtc.conn.GetSenders() {
-		rtc.screen.Log("[WebRTC] Remove track - " + sender.Track().Label())
-		rtc.conn.RemoveTrack(sender)
-	}
-
-	// Audio Track
-	opusTrack, err := rtc.conn.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), "audio", "pion1")
+	// Create Offer
+	offer, err := p.conn.CreateOffer(nil)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] create new audio track failed: " + err.Error())
+		p.screen.Log("[WebRTC] create offer failed: " + err.Error())
 		return
 	}
+	p.screen.Log("[WebRTC] create offer to " + p.id)
 
-	rtc.screen.Log("[WebRTC] create new audio track")
+	p.setLocalSDP(offer)
+}
 
-	_, err = rtc.conn.AddTrack(opusTrack)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] add new audio track failed: " + err.Error())
+// setLocalSDP sets and sends desc, or holds it in manual sdp mode
+func (p *peer) setLocalSDP(desc webrtc.SessionDescription) {
+	if p.rtc.isManualSDP() {
+		p.localDesc = &desc
+		p.screen.Log(fmt.Sprintf("[SDP] local %s for %s created, /setlocal to apply", desc.Type, p.id))
 		return
 	}
-	rtc.screen.Log("[WebRTC] add new audio track")
 
-	// Video Track
-	vp8Track, err := rtc.conn.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), "video", "pion2")
+	err := p.conn.SetLocalDescription(desc)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] create new video track failed: " + err.Error())
+		p.screen.Log("[WebRTC] set local sdp failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] create new video track")
-
-	_, err = rtc.conn.AddTrack(vp8Track)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] add new video track failed: " + err.Error())
-		return
+	p.screen.Log("[WebRTC] local sdp set")
+	if desc.Type == webrtc.SDPTypeAnswer {
+		p.logCodecs()
 	}
-	rtc.screen.Log("[WebRTC] add new video track")
-
-	// build pipelines
-	audioSrc := "audiotestsrc ! audioconvert ! queue"
-	videoSrc := "videotestsrc pattern=snow ! video/x-raw,width=320,height=240 ! queue"
-
-	pipe1 := gst.CreatePipeline(webrtc.Opus, []*webrtc.Track{opusTrack}, audioSrc)
-	pipe2 := gst.CreatePipeline(webrtc.VP8, []*webrtc.Track{vp8Track}, videoSrc)
-	rtc.pipes = append(rtc.pipes, pipe1, pipe2) // lazy, have to remove pipes first
-
-	// starting...
-	pipe1.Start()
-	pipe2.Start()
-
-	// if rtc.isPeered {
-	// 	// already in connection, re-offer?
-	// 	rtc.CreateOffer()
-	// }
+	p.sendLocalSDP(desc)
 }
 
-func (rtc *WebRTC) CreateOffer() {
-	if rtc.conn == nil {
-		rtc.screen.Log("[System] No peer connection to make offer")
-		return
-	}
-
-	if rtc.ws.GetPeer() == "" {
-		rtc.screen.Log("[System] Need to set peer ID first")
+func (p *peer) sendLocalSDP(desc webrtc.SessionDescription) {
+	sdp, err := EncodeWith(p.filterSDP(desc, "local"), p.rtc.getEncoding())
+	if err != nil {
+		p.screen.Log("[WebRTC] sdp encode failed: " + err.Error())
 		return
 	}
 
-	rtc.isOffering = true
+	p.send(protocol.Message{Topic: "sdp", Body: sdp})
+}
 
-	// Create Offer
-	offer, err := rtc.conn.CreateOffer(nil)
+func (p *peer) createAnswer() {
+	answer, err := p.conn.CreateAnswer(nil)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] create offer failed: " + err.Error())
+		p.screen.Log("[WebRTC] create answer failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] create offer")
+	p.screen.Log("[WebRTC] answer created")
 
-	rtc.setLocalSDP(offer)
+	p.setLocalSDP(answer)
 }
 
-func (rtc *WebRTC) setLocalSDP(desc webrtc.SessionDescription) {
-	err := rtc.conn.SetLocalDescription(desc)
+func (p *peer) setRemoteSDP(sdp string) {
+	desc := webrtc.SessionDescription{}
+	err := Decode(sdp, &desc)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] set local sdp failed: " + err.Error())
+		p.screen.Log("[WebRTC] sdp decode failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] local sdp set")
 
-	sdp, err := Encode(desc)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] sdp encode failed: " + err.Error())
+	if desc.Type == webrtc.SDPTypeRollback {
+		// not held in manual sdp mode, it only withdraws an offer
+		p.remoteRollback()
 		return
 	}
+	desc = p.filterSDP(desc, "remote")
 
-	rtc.ws.SendMessage(Message{"sdp", sdp})
-}
-
-func (rtc *WebRTC) createAnswer() {
-	answer, err := rtc.conn.CreateAnswer(nil)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] create answer failed: " + err.Error())
+	if p.rtc.isManualSDP() {
+		p.remoteDesc = &desc
+		p.screen.Log(fmt.Sprintf("[SDP] hold remote %s from %s, /setremote to apply", desc.Type, p.id))
 		return
 	}
-	rtc.screen.Log("[WebRTC] answer created")
-
-	rtc.setLocalSDP(answer)
-}
 
-func (rtc *WebRTC) SetRemoteSDP(sdp string) {
-	desc := webrtc.SessionDescription{}
-	err := Decode(sdp, &desc)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] sdp decode failed: " + err.Error())
+	// perfect negotiation, offers crossing each other
+	p.ignoreOffer = false
+	if desc.Type == webrtc.SDPTypeOffer && (p.isOffering || p.conn.SignalingState() != webrtc.SignalingStateStable) {
+		if !p.handleGlare() {
+			return
+		}
+	}
+	if desc.Type == webrtc.SDPTypeOffer && !p.handleRestart(desc) {
 		return
 	}
 
-	err = rtc.conn.SetRemoteDescription(desc)
+	err = p.conn.SetRemoteDescription(desc)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] set remote sdp failed: " + err.Error())
+		p.screen.Log("[WebRTC] set remote sdp failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] remote sdp set")
+	p.screen.Log("[WebRTC] remote sdp set from " + p.id)
+	p.flushCandidates()
 
-	if rtc.isOffering {
-		rtc.isOffering = false
+	if desc.Type == webrtc.SDPTypeOffer {
+		p.createAnswer()
 	} else {
-		// suppose to answer if not in offering mode
-		rtc.createAnswer()
+		p.isOffering = false
+		p.logCodecs()
 	}
 }
 
-func (rtc *WebRTC) SetCandidate(data string) {
+func (p *peer) setCandidate(data string) {
 	var ice webrtc.ICECandidateInit
 	err := Decode(data, &ice)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] decode IceCandidate failed: " + err.Error())
+		p.screen.Log("[WebRTC] decode IceCandidate failed: " + err.Error())
 		return
 	}
-	rtc.screen.Log("[WebRTC] decoded IceCandidate: " + ice.Candidate)
+	p.screen.Log("[WebRTC] decoded IceCandidate: " + ice.Candidate)
 
-	err = rtc.conn.AddICECandidate(ice)
-	if err != nil {
-		rtc.screen.Log("[WebRTC] add IceCandidate failed: " + err.Error())
+	if p.rtc.filterCandidate(ice, "remote") {
 		return
 	}
-	rtc.screen.Log("[WebRTC] add IceCandidate from peer")
+	if p.holdCandidate(&p.remoteCandidates, ice, "remote") {
+		return
+	}
+	p.addRemoteCandidate(ice)
 }
 
-func (rtc *WebRTC) Init() {
-	rtc.Reset()
-
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+func newPeer(rtc *WebRTC, id string, config webrtc.Configuration, settings Settings) (*peer, error) {
+	p := &peer{rtc: rtc, screen: rtc.screen, id: id, media: make(map[webrtc.RTPCodecType]*mediaTrack)}
+	err := p.connect(config, settings)
+	if err != nil {
+		return nil, err
 	}
+	return p, nil
+}
 
-	rr, err := webrtc.NewPeerConnection(config)
+// connect creates the peer connection, callbacks of a replaced one are ignored
+func (p *peer) connect(config webrtc.Configuration, settings Settings) error {
+	api, err := newAPI(settings)
 	if err != nil {
-		rtc.screen.Log("[WebRTC] create peer connection failed: " + err.Error())
-		return
+		return err
 	}
-	rtc.conn = rr
+	conn, err := api.NewPeerConnection(config)
+	if err != nil {
+		return err
+	}
+	p.connMu.Lock()
+	p.conn = conn
+	p.connMu.Unlock()
+	id := p.id
 
 	// // Allow us to receive 1 audio track, and 1 video track
-	// if _, err = rtc.conn.AddTransceiver(webrtc.RTPCodecTypeAudio); err != nil {
-	// 	rtc.screen.Log("[WebRTC] AddTransceiver Audio failed")
+	// if _, err = p.conn.AddTransceiver(webrtc.RTPCodecTypeAudio); err != nil {
+	// 	p.screen.Log("[WebRTC] AddTransceiver Audio failed")
 	// }
-	// if _, err = rtc.conn.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
-	// 	rtc.screen.Log("[WebRTC] AddTransceiver Video failed")
+	// if _, err = p.conn.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
+	// 	p.screen.Log("[WebRTC] AddTransceiver Video failed")
 	// }
 
-	rtc.screen.Log("[WebRTC] peer connection created")
+	p.screen.Log("[WebRTC] peer connection created for " + id)
 
-	rtc.conn.OnSignalingStateChange(func(state webrtc.SignalingState) {
-		rtc.screen.Log("[WebRTC] OnSignalingStateChange -> " + state.String())
+	conn.OnSignalingStateChange(func(state webrtc.SignalingState) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnSignalingStateChange -> %s", id, state))
 	})
 
-	rtc.conn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		rtc.screen.Log("[WebRTC] OnICEConnectionStateChange -> " + state.String())
+	conn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnICEConnectionStateChange -> %s", id, state))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if conn == p.conn {
+			p.logReconnect(state)
+		}
 	})
 
-	rtc.conn.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
-		rtc.screen.Log("[WebRTC] OnICEGatheringStateChange -> " + state.String())
+	conn.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnICEGatheringStateChange -> %s", id, state))
 	})
 
-	rtc.conn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		rtc.screen.Log("[WebRTC] OnConnectionStateChange -> " + state.String())
-		if state == webrtc.PeerConnectionStateConnected {
+	conn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnConnectionStateChange -> %s", id, state))
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if state == webrtc.PeerConnectionStateConnected && conn == p.conn {
 			// peer established
-			rtc.isPeered = true
+			p.isPeered = true
 		}
 	})
 
-	rtc.conn.OnTrack(func(track *webrtc.Track, rec *webrtc.RTPReceiver) {
-		rtc.screen.Log(fmt.Sprintf("[WebRTC] OnTrack -> %s - %s", track.Kind().String(), track.ID()))
+	conn.OnTrack(func(track *webrtc.Track, rec *webrtc.RTPReceiver) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnTrack -> %s - %s", id, track.Kind().String(), track.ID()))
 	})
 
-	rtc.conn.OnDataChannel(func(channel *webrtc.DataChannel) {
-		rtc.screen.Log("[WebRTC] OnDataChannel: " + channel.Label())
-		rtc.registerDataCallback(channel)
+	conn.OnDataChannel(func(channel *webrtc.DataChannel) {
+		p.screen.Log(fmt.Sprintf("[WebRTC] %s OnDataChannel: %s", id, channel.Label()))
+		p.registerDataCallback(channel)
 	})
 
-	rtc.conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		// TODO: send via websocket
-		if candidate != nil {
-			rtc.screen.Log("[WebRTC] OnICECandidate: " + candidate.String())
-			body, err := Encode(candidate.ToJSON())
-			if err != nil {
-				rtc.screen.Log("[WebRTC] encode IceCandidate failed")
-				return
-			}
-			rtc.ws.SendMessage(Message{"candidate", string(body)})
+	conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil && p.current(conn) {
+			p.screen.Log("[WebRTC] OnICECandidate: " + candidate.String())
+			p.sendLocalCandidate(candidate.ToJSON())
 		}
 	})
+	return nil
+}
+
+// current tells if conn is the peer connection in use, without mu, pion
+// holds its ICE agent until OnICECandidate returns and mu may be waiting for it
+func (p *peer) current(conn *webrtc.PeerConnection) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return conn == p.conn
 }
@@ -1,70 +1,98 @@
 package network
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"testrtc2/protocol"
 	"testrtc2/screen"
 
 	"github.com/gorilla/websocket"
 )
 
-type WebSocket struct {
-	screen *screen.Screen
-	rtc    *WebRTC
-	conn   *websocket.Conn
-	userID string
-	peerID string
-	mu     sync.Mutex // write mutex
-}
-
-type ActionPacket struct {
-	Action string `json:"action"`
-}
+const (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
 
-type InitPacket struct {
-	ActionPacket
-	ID string `json:"id"`
+// WebSocket is the signal server client, over websocket (ws://, wss://)
+// or HTTP long-poll (http://, https://) where websocket is blocked
+type WebSocket struct {
+	screen     *screen.Screen
+	rtc        *WebRTC
+	conn       packetConn
+	addr       *url.URL
+	tlsConfig  *tls.Config
+	authToken  string
+	tokenQuery bool // send token in query string instead of header
+	recorder   *Recorder
+	session    int        // bumped on reset, stops reconnecting of old session
+	mu         sync.Mutex // write mutex, also guards conn + session
+
+	replaying   bool
+	resumeToken string // from server, to get back the same ID
+	userID      string
+	peerID      string
+	room        string
+	members     []string
+	stateMu     sync.Mutex // guards the fields above, set by the read loop and commands
 }
 
-type Message struct {
-	Topic string `json:"topic"`
-	Body  string `json:"body"`
+func NewWebSocket(screen *screen.Screen) *WebSocket {
+	return &WebSocket{screen: screen}
 }
 
-type ErrorPacket struct {
-	ActionPacket
-	Msg string `json:"msg"`
+func (ws *WebSocket) SetWebRTC(rtc *WebRTC) {
+	ws.rtc = rtc
 }
 
-type RecvPacket struct {
-	ActionPacket
-	From string  `json:"from"`
-	Msg  Message `json:"msg"`
+// SetAuthToken sets the token sent when dialing,
+// as Authorization: Bearer header or as ?token= when inQuery
+func (ws *WebSocket) SetAuthToken(token string, inQuery bool) {
+	ws.authToken = token
+	ws.tokenQuery = inQuery
 }
 
-type SendPacket struct {
-	ActionPacket
-	To  string  `json:"to"`
-	Msg Message `json:"msg"`
+// SetRecorder records every packet read and written from now on
+func (ws *WebSocket) SetRecorder(recorder *Recorder) {
+	ws.recorder = recorder
 }
 
-func NewWebSocket(screen *screen.Screen) *WebSocket {
-	return &WebSocket{screen, nil, nil, "", "", sync.Mutex{}}
+func (ws *WebSocket) record(dir string, packet []byte) {
+	if ws.recorder == nil {
+		return
+	}
+	err := ws.recorder.Record(dir, packet)
+	if err != nil {
+		ws.screen.Log("[WebSocket] record packet failed: " + err.Error())
+	}
 }
 
-func (ws *WebSocket) SetWebRTC(rtc *WebRTC) {
-	ws.rtc = rtc
+// SetTLSConfig sets the TLS config used to dial wss:// servers
+func (ws *WebSocket) SetTLSConfig(config *tls.Config) {
+	ws.tlsConfig = config
 }
 
 func (ws *WebSocket) Reset() {
+	ws.stateMu.Lock()
+	ws.replaying = false
+	ws.resumeToken = ""
 	ws.userID = ""
 	ws.peerID = ""
+	ws.room = ""
+	ws.members = nil
+	ws.stateMu.Unlock()
 
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.session++
 	if ws.conn != nil {
 		ws.conn.Close()
 		ws.screen.Log("[System] Close previous web socket")
@@ -72,110 +100,382 @@ func (ws *WebSocket) Reset() {
 	}
 }
 
-func (ws *WebSocket) GetPeer() string {
-	return ws.peerID
+func (ws *WebSocket) GetID() string {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	return ws.userID
+}
+
+// getRoom returns the joined room, empty when none
+func (ws *WebSocket) getRoom() string {
+	ws.stateMu.Lock()
+	defer ws.stateMu.Unlock()
+	return ws.room
+}
+
+// GetPeers returns the selected peer, or with PeerAll every room member
+// and every peer having a connection
+func (ws *WebSocket) GetPeers() []string {
+	ws.stateMu.Lock()
+	peerID, userID := ws.peerID, ws.userID
+	members := append([]string{}, ws.members...)
+	ws.stateMu.Unlock()
+
+	if peerID != PeerAll {
+		if peerID == "" {
+			return nil
+		}
+		return []string{peerID}
+	}
+
+	seen := map[string]bool{userID: true}
+	ids := []string{}
+	for _, id := range append(ws.rtc.PeerIDs(), members...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
 }
 
+// SetPeer selects the peer commands apply to, and says hello to it
+// PeerAll selects every peer
 func (ws *WebSocket) SetPeer(id string) {
 	ws.screen.Log("[System] Set Peer ID: " + id)
+	ws.stateMu.Lock()
 	ws.peerID = id
+	userID := ws.userID
+	ws.stateMu.Unlock()
+	if userID != "" && id != PeerAll {
+		ws.rtc.SendHello(id)
+	}
 }
 
+// sendSafePacket writes and records data, packets dropped while replaying are not recorded
 func (ws *WebSocket) sendSafePacket(data []byte) error {
+	ws.stateMu.Lock()
+	replaying := ws.replaying
+	ws.stateMu.Unlock()
+
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
-	return ws.conn.WriteMessage(websocket.TextMessage, data)
+	if ws.conn == nil {
+		if replaying {
+			ws.screen.Log(fmt.Sprintf("[Replay] drop outgoing packet: %d bytes", len(data)))
+			return nil
+		}
+		return fmt.Errorf("not connected")
+	}
+	ws.record("out", data)
+	return ws.conn.WritePacket(data)
 }
 
-func (ws *WebSocket) SendMessage(msg Message) {
-	sp := SendPacket{ActionPacket{"send"}, ws.peerID, msg}
-	packet, err := json.Marshal(sp)
+func (ws *WebSocket) sendPacket(obj interface{}) error {
+	packet, err := json.Marshal(obj)
 	if err != nil {
-		ws.screen.Log("[WebSocket] json encode packet failed: " + err.Error())
+		return err
+	}
+	return ws.sendSafePacket(packet)
+}
+
+func (ws *WebSocket) SendMessage(to string, msg protocol.Message) {
+	sp := protocol.SendPacket{ActionPacket: protocol.ActionPacket{Action: "send"}, To: to, Msg: msg}
+	err := ws.sendPacket(sp)
+	if err != nil {
+		ws.screen.Log("[WebSocket] write message failed: " + err.Error())
 		return
 	}
-	err = ws.sendSafePacket(packet)
+
+	ws.screen.Log(fmt.Sprintf("[WebSocket] sent mail to %s: <%s> %d bytes", to, msg.Topic, len(msg.Body)))
+}
+
+// BroadcastMessage sends msg to every other member of the joined room
+func (ws *WebSocket) BroadcastMessage(msg protocol.Message) {
+	room := ws.getRoom()
+	if room == "" {
+		ws.screen.Log("[System] Need to join a room first")
+		return
+	}
+
+	sp := protocol.SendPacket{ActionPacket: protocol.ActionPacket{Action: "send"}, Room: room, Msg: msg}
+	err := ws.sendPacket(sp)
 	if err != nil {
 		ws.screen.Log("[WebSocket] write message failed: " + err.Error())
+		return
 	}
 
-	ws.screen.Log(fmt.Sprintf("[WebSocket] sent mail to %s: <%s> %d bytes", ws.peerID, msg.Topic, len(msg.Body)))
+	ws.screen.Log(fmt.Sprintf("[WebSocket] sent mail to room %s: <%s> %d bytes", room, msg.Topic, len(msg.Body)))
+}
+
+func (ws *WebSocket) Ping() {
+	ids := ws.GetPeers()
+	if len(ids) == 0 {
+		ws.screen.Log("[System] Need to set peer ID first")
+		return
+	}
+	for _, id := range ids {
+		ws.SendMessage(id, protocol.Message{Topic: "ping"})
+	}
+}
+
+func (ws *WebSocket) Join(room string) {
+	err := ws.sendPacket(protocol.JoinPacket{ActionPacket: protocol.ActionPacket{Action: "join"}, Room: room})
+	if err != nil {
+		ws.screen.Log("[WebSocket] join room failed: " + err.Error())
+		return
+	}
+	ws.screen.Log("[WebSocket] joining room " + room)
+}
+
+func (ws *WebSocket) Leave() {
+	room := ws.getRoom()
+	if room == "" {
+		ws.screen.Log("[System] Not in any room")
+		return
+	}
+
+	err := ws.sendPacket(protocol.ActionPacket{Action: "leave"})
+	if err != nil {
+		ws.screen.Log("[WebSocket] leave room failed: " + err.Error())
+		return
+	}
+	ws.screen.Log("[WebSocket] left room " + room)
+	ws.stateMu.Lock()
+	ws.room = ""
+	ws.members = nil
+	ws.stateMu.Unlock()
+}
+
+// RequestMembers asks the server for the member list of the joined room
+func (ws *WebSocket) RequestMembers() {
+	if ws.getRoom() == "" {
+		ws.screen.Log("[System] Need to join a room first")
+		return
+	}
+
+	err := ws.sendPacket(protocol.ActionPacket{Action: "members"})
+	if err != nil {
+		ws.screen.Log("[WebSocket] request members failed: " + err.Error())
+	}
+}
+
+// removeMember drops id from members, ws.stateMu held
+func (ws *WebSocket) removeMember(id string) {
+	for i, member := range ws.members {
+		if member == id {
+			ws.members = append(ws.members[:i], ws.members[i+1:]...)
+			return
+		}
+	}
 }
 
 func (ws *WebSocket) handleMessage(message []byte) (err error) {
-	var ap ActionPacket
+	var ap protocol.ActionPacket
 	err = json.Unmarshal(message, &ap)
 	if err != nil {
 		return
 	}
 	switch ap.Action {
 	case "init": // identity
-		var ip InitPacket
+		var ip protocol.InitPacket
 		err = json.Unmarshal(message, &ip)
 		if err != nil {
 			return
 		}
+		ws.stateMu.Lock()
+		resumeToken, userID := ws.resumeToken, ws.userID
 		ws.userID = ip.ID
-		ws.screen.Log("[WebSocket] my new ID: " + ip.ID)
+		ws.resumeToken = ip.Token
+		ws.stateMu.Unlock()
+
+		if resumeToken != "" && userID == ip.ID {
+			ws.screen.Log("[WebSocket] resumed ID: " + ip.ID)
+		} else {
+			if resumeToken != "" {
+				ws.screen.Log(fmt.Sprintf("[WebSocket] resume failed, ID changed from %s", userID))
+			}
+			ws.screen.Log("[WebSocket] my new ID: " + ip.ID)
+		}
 		ws.screen.SetTitle(fmt.Sprintf("My ID = %s. Enter command ...", ip.ID))
 
 	case "error": // error
-		var ep ErrorPacket
+		var ep protocol.ErrorPacket
 		err = json.Unmarshal(message, &ep)
 		if err != nil {
 			return
 		}
 		ws.screen.Log("[WebSocket] error: " + ep.Msg)
 
+	case "members": // reply of join / members
+		var mp protocol.MembersPacket
+		err = json.Unmarshal(message, &mp)
+		if err != nil {
+			return
+		}
+		ws.stateMu.Lock()
+		ws.room = mp.Room
+		ws.members = mp.Members
+		ws.stateMu.Unlock()
+		ws.screen.Log(fmt.Sprintf("[WebSocket] room %s members: %s", mp.Room, strings.Join(mp.Members, ", ")))
+
+	case "presence": // someone joined or left the room
+		var pp protocol.PresencePacket
+		err = json.Unmarshal(message, &pp)
+		if err != nil {
+			return
+		}
+		ws.stateMu.Lock()
+		ws.removeMember(pp.ID)
+		if pp.Event == "join" {
+			ws.members = append(ws.members, pp.ID)
+		}
+		ws.stateMu.Unlock()
+		if pp.Event == "leave" {
+			ws.rtc.ClosePeer(pp.ID)
+		}
+		ws.screen.Log(fmt.Sprintf("[WebSocket] room %s: %s %s", pp.Room, pp.ID, pp.Event))
+
 	case "recv": // letter from other peer
-		var rp RecvPacket
+		var rp protocol.RecvPacket
 		err = json.Unmarshal(message, &rp)
 		if err != nil {
 			return
 		}
 
-		ws.peerID = rp.From
-		ws.screen.Log(fmt.Sprintf("[WebSocket] got mail from %s: <%s> %d bytes", rp.From, rp.Msg.Topic, len(rp.Msg.Body)))
-
-		switch rp.Msg.Topic {
-		case "ping":
-			ws.SendMessage(Message{"pong", ""})
-
-		case "sdp":
-			ws.rtc.SetRemoteSDP(rp.Msg.Body)
-
-		case "candidate":
-			ws.rtc.SetCandidate(rp.Msg.Body)
+		ws.stateMu.Lock()
+		first := ws.peerID == ""
+		ws.stateMu.Unlock()
+		if first {
+			// nobody selected yet, talk back to the first peer
+			ws.SetPeer(rp.From)
 		}
-
+		if rp.Room != "" {
+			ws.screen.Log(fmt.Sprintf("[WebSocket] got mail from %s in room %s: <%s> %d bytes", rp.From, rp.Room, rp.Msg.Topic, len(rp.Msg.Body)))
+		} else {
+			ws.screen.Log(fmt.Sprintf("[WebSocket] got mail from %s: <%s> %d bytes", rp.From, rp.Msg.Topic, len(rp.Msg.Body)))
+		}
+		ws.rtc.HandleMessage(rp.From, rp.Msg)
 	}
 	return
 }
 
+// LoopMessage reads incoming signal until the connection is reset by Connect,
+// reconnecting with backoff whenever the read fails
 func (ws *WebSocket) LoopMessage() {
-	defer ws.conn.Close()
+	ws.mu.Lock()
+	session := ws.session
+	conn := ws.conn
+	ws.mu.Unlock()
+
 	for {
-		_, message, err := ws.conn.ReadMessage()
+		message, err := conn.ReadPacket()
 		if err != nil {
+			if !ws.isSession(session) {
+				// closed on purpose
+				return
+			}
 			ws.screen.Log("[WebSocket] read failed: " + err.Error())
-			return
+			if err == errRejected {
+				// rejected by server, retrying will not help
+				ws.screen.SetTitle("Rejected by server. Enter command ...")
+				return
+			}
+
+			conn = ws.reconnect(session)
+			if conn == nil {
+				return
+			}
+			continue
 		}
 
 		ws.screen.Log(fmt.Sprintf("[WebSocket] read: %d bytes", len(message)))
+		ws.record("in", message)
 
 		err = ws.handleMessage(message)
 		if err != nil {
 			ws.screen.Log("[WebSocket] handle message failed: " + err.Error())
-			return
 		}
 	}
 }
 
-func (ws *WebSocket) Connect(addr string) {
-	ws.Reset()
+func (ws *WebSocket) isSession(session int) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.session == session
+}
+
+// reconnect dials again with exponential backoff, resuming the previous user ID
+// the peer connection is kept untouched
+func (ws *WebSocket) reconnect(session int) packetConn {
+	ws.screen.SetTitle("Reconnecting ...")
+	backoff := reconnectMinBackoff
+
+	for {
+		ws.screen.Log(fmt.Sprintf("[WebSocket] reconnect in %s", backoff))
+		time.Sleep(backoff)
+
+		if !ws.isSession(session) {
+			return nil
+		}
 
-	u := url.URL{Scheme: "ws", Host: addr, Path: "/"}
-	ws.screen.Log("[WebSocket] connecting to " + u.String())
+		ws.stateMu.Lock()
+		resumeToken := ws.resumeToken
+		ws.stateMu.Unlock()
+		c, err := ws.dial(resumeToken)
+		if err != nil {
+			ws.screen.Log("[WebSocket] dial failed: " + err.Error())
+			if err == errRejected {
+				ws.screen.SetTitle("Rejected by server. Enter command ...")
+				return nil
+			}
+			backoff *= 2
+			if backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			continue
+		}
+
+		ws.mu.Lock()
+		if ws.session != session {
+			// reset while dialing
+			ws.mu.Unlock()
+			c.Close()
+			return nil
+		}
+		ws.conn.Close()
+		ws.conn = c
+		ws.mu.Unlock()
+
+		ws.screen.Log("[WebSocket] reconnected")
+		if room := ws.getRoom(); room != "" {
+			ws.Join(room)
+		}
+		return c
+	}
+}
+
+func (ws *WebSocket) dial(resumeToken string) (packetConn, error) {
+	u := *ws.addr
+	header := http.Header{}
+	query := u.Query()
+	if resumeToken != "" {
+		query.Set("resume", resumeToken)
+	}
+	if ws.authToken != "" {
+		if ws.tokenQuery {
+			query.Set("token", ws.authToken)
+		} else {
+			header.Set("Authorization", "Bearer "+ws.authToken)
+		}
+	}
+	u.RawQuery = query.Encode()
+	// log the address without credentials
+	ws.screen.Log("[WebSocket] connecting to " + ws.addr.String())
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return dialPoll(u, header, ws.tlsConfig)
+	}
 
 	dialer := websocket.Dialer{
 		ReadBufferSize:  65535,
@@ -183,20 +483,90 @@ func (ws *WebSocket) Connect(addr string) {
 		NetDial: (&net.Dialer{
 			Timeout: 5 * time.Second,
 		}).Dial,
+		TLSClientConfig: ws.tlsConfig,
 	}
 
-	c, _, err := dialer.Dial(u.String(), nil)
+	c, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusForbidden {
+			return nil, errRejected
+		}
+		return nil, err
+	}
+	return &wsConn{c}, nil
+}
+
+// Connect dials addr, a ws:// wss:// http:// https:// URL or a bare host:port
+func (ws *WebSocket) Connect(addr string) {
+	ws.Reset()
+
+	u, err := ParseSignalURL(addr)
+	if err != nil {
+		ws.screen.Log("[WebSocket] bad address: " + err.Error())
+		return
+	}
+	ws.addr = u
+
+	c, err := ws.dial("")
 	if err != nil {
 		ws.screen.Log("[WebSocket] dial failed: " + err.Error())
 		return
 	}
+
+	ws.mu.Lock()
 	ws.conn = c
+	ws.mu.Unlock()
 
 	// handle incoming signal
 	go ws.LoopMessage()
 	ws.rtc.Init()
 }
 
+// Replay feeds the incoming packets of a recording to a fresh peer connection,
+// with the original timing, no signal server needed. Outgoing packets are dropped
+func (ws *WebSocket) Replay(path string) {
+	records, err := LoadRecords(path)
+	if err != nil {
+		ws.screen.Log("[Replay] load recording failed: " + err.Error())
+		return
+	}
+
+	ws.Reset()
+	ws.mu.Lock()
+	session := ws.session
+	ws.mu.Unlock()
+	ws.stateMu.Lock()
+	ws.replaying = true
+	ws.stateMu.Unlock()
+	ws.rtc.Init()
+
+	ws.screen.Log(fmt.Sprintf("[Replay] %s: %d records", path, len(records)))
+	var last time.Time
+	count := 0
+	for _, rec := range records {
+		if rec.Dir != "in" {
+			continue
+		}
+		if !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		if !ws.isSession(session) {
+			ws.screen.Log("[Replay] stopped")
+			return
+		}
+
+		ws.screen.Log(fmt.Sprintf("[Replay] read: %d bytes", len(rec.Packet)))
+		err = ws.handleMessage(rec.Packet)
+		if err != nil {
+			ws.screen.Log("[Replay] handle message failed: " + err.Error())
+		}
+		count++
+	}
+	ws.screen.Log(fmt.Sprintf("[Replay] done, %d packets replayed", count))
+}
+
 // func (ws *WebSocket) Loop(quit chan struct{}) {
 // 	interrupt := make(chan os.Signal, 1)
 // 	signal.Notify(interrupt, os.Interrupt)
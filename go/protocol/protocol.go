@@ -0,0 +1,63 @@
+// Package protocol holds the packets of the signal server, shared by
+// the client and the server without pulling in webrtc or gstreamer
+package protocol
+
+type ActionPacket struct {
+	Action string `json:"action"`
+}
+
+type InitPacket struct {
+	ActionPacket
+	ID    string `json:"id"`
+	Token string `json:"token,omitempty"` // resume token, pass as ?resume= when reconnecting
+}
+
+type Message struct {
+	Topic string `json:"topic"`
+	Body  string `json:"body"`
+}
+
+type ErrorPacket struct {
+	ActionPacket
+	Msg string `json:"msg"`
+}
+
+type RecvPacket struct {
+	ActionPacket
+	From string  `json:"from"`
+	Room string  `json:"room,omitempty"` // set when broadcast to room
+	Msg  Message `json:"msg"`
+}
+
+// SendPacket goes to peer `To`, or to everyone in `Room` when set
+type SendPacket struct {
+	ActionPacket
+	To   string  `json:"to"`
+	Room string  `json:"room,omitempty"`
+	Msg  Message `json:"msg"`
+}
+
+type JoinPacket struct {
+	ActionPacket
+	Room string `json:"room"`
+}
+
+// MembersPacket replies to join and members actions
+type MembersPacket struct {
+	ActionPacket
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// PresencePacket tells room members that someone joined or left
+type PresencePacket struct {
+	ActionPacket
+	Room  string `json:"room"`
+	ID    string `json:"id"`
+	Event string `json:"event"` // join, leave
+}
+
+// PollSession is the reply of opening a long-poll session
+type PollSession struct {
+	Session string `json:"session"`
+}
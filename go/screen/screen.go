@@ -24,11 +24,18 @@ func NewScreen() *Screen {
 }
 
 func (s *Screen) Log(rline string) {
-	// fmt.Println(rline)
+	if s.txtLog == nil {
+		// headless, not initialized
+		fmt.Println(rline)
+		return
+	}
 	s.txtLog.Println(rline)
 }
 
 func (s *Screen) SetTitle(title string) {
+	if s.txtInput == nil {
+		return
+	}
 	s.txtInput.SetTitle(title)
 }
 
@@ -85,9 +92,44 @@ func (s *Screen) Init() {
 	s.txtHelp.Println("Text command")
 	s.txtHelp.Println(" /new    : new rtc")
 	s.txtHelp.Println(" /peer id: set peer")
+	s.txtHelp.Println(" /peer all: all peers")
+	s.txtHelp.Println(" /peers  : list peers")
+	s.txtHelp.Println(" /ping   : ping peer")
+	s.txtHelp.Println(" /join rm: join room")
+	s.txtHelp.Println(" /leave  : leave room")
+	s.txtHelp.Println(" /members: list room")
+	s.txtHelp.Println(" /broadcast: ping room")
 	s.txtHelp.Println(" /offer  : send offer")
+	s.txtHelp.Println(" /answer : send answer")
+	s.txtHelp.Println(" /sdpmode manual|auto")
+	s.txtHelp.Println(" /setlocal: set local sdp")
+	s.txtHelp.Println(" /sendsdp: send local sdp")
+	s.txtHelp.Println(" /setremote: set held sdp")
+	s.txtHelp.Println(" /rollback: drop offer")
 	s.txtHelp.Println(" /media  : add media")
+	s.txtHelp.Println(" /media kind [codec] [src]")
+	s.txtHelp.Println(" /replace kind src")
 	s.txtHelp.Println(" /data   : add channel")
+	s.txtHelp.Println(" /transceiver kind dir")
+	s.txtHelp.Println(" /transceiver n dir")
+	s.txtHelp.Println(" /transceivers: list")
+	s.txtHelp.Println(" /codecs c[:fmtp],..")
+	s.txtHelp.Println("   default|show")
+	s.txtHelp.Println(" /restartice: reconnect")
+	s.txtHelp.Println(" /icemode manual|auto")
+	s.txtHelp.Println(" /sendice: send held ice")
+	s.txtHelp.Println(" /addice : add held ice")
+	s.txtHelp.Println(" /icequeue: list held ice")
+	s.txtHelp.Println(" /icefilter rules|off")
+	s.txtHelp.Println("   e.g. type!=relay")
+	s.txtHelp.Println(" /config show|ice|policy")
+	s.txtHelp.Println("   bundle|rtcpmux|pool")
+	s.txtHelp.Println("   ports|nat|network")
+	s.txtHelp.Println("   timeout name duration")
+	s.txtHelp.Println("   wait type duration")
+	s.txtHelp.Println(" /replay f: replay file")
+	s.txtHelp.Println(" /blob   : manual blob")
+	s.txtHelp.Println(" /encoding e: body format")
 
 	s.screen = screen
 }
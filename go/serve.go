@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"testrtc2/server"
+)
+
+// serve runs the built-in signal server, same protocol as signal.py
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:6789", "signal server listen address")
+	resumeSecret := fs.String("resume-secret", "", "secret to sign resume tokens, share it between servers to keep user IDs (default read from -resume-secret-file)")
+	resumeSecretFile := fs.String("resume-secret-file", defaultResumeSecretFile(), "file keeping the resume secret across restarts, created on first run")
+	resumeTTL := fs.Duration("resume-ttl", server.DefaultResumeTTL, "resume token lifetime")
+	tlsCert := fs.String("tls-cert", "", "server certificate, serve wss:// when set")
+	tlsKey := fs.String("tls-key", "", "server certificate key")
+	clientCA := fs.String("client-ca", "", "require client certificates signed by this CA bundle")
+	authMode := fs.String("auth", server.AuthNone, "client authentication: none, secret, hmac")
+	authSecret := fs.String("auth-secret", "", "shared secret for -auth secret or hmac")
+	fs.Parse(args)
+
+	switch *authMode {
+	case server.AuthNone, server.AuthSecret, server.AuthHMAC:
+	default:
+		log.Fatal("unknown -auth " + *authMode + ", need none, secret or hmac")
+	}
+	if *authMode != server.AuthNone && *authSecret == "" {
+		log.Fatal("-auth-secret is required with -auth " + *authMode)
+	}
+
+	if *resumeSecret == "" {
+		if *resumeSecretFile == "" {
+			log.Fatal("-resume-secret or -resume-secret-file is required")
+		}
+		secret, err := server.LoadResumeSecret(*resumeSecretFile)
+		if err != nil {
+			log.Fatal("resume secret: " + err.Error())
+		}
+		*resumeSecret = secret
+	}
+
+	sv := server.NewServer(server.Options{
+		ResumeSecret: *resumeSecret,
+		ResumeTTL:    *resumeTTL,
+		AuthMode:     *authMode,
+		AuthSecret:   *authSecret,
+	})
+	if *tlsCert != "" {
+		log.Fatal(sv.ListenAndServeTLS(*listen, *tlsCert, *tlsKey, *clientCA))
+	}
+	log.Fatal(sv.ListenAndServe(*listen))
+}
+
+// defaultResumeSecretFile is in the user config dir, empty when there is none
+func defaultResumeSecretFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "testrtc2", "resume-secret")
+}
+
+// token prints an HMAC-signed token for servers running with -auth hmac
+func token(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	secret := fs.String("secret", "", "same secret as the server -auth-secret")
+	ttl := fs.Duration("ttl", 24*time.Hour, "token lifetime")
+	fs.Parse(args)
+
+	if *secret == "" {
+		log.Fatal("-secret is required")
+	}
+	fmt.Println(server.IssueToken(*secret, *ttl))
+}
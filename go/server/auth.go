@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuthNone   = "none"   // anyone can connect
+	AuthSecret = "secret" // token must equal the shared secret
+	AuthHMAC   = "hmac"   // token must be signed by the secret and not expired, see IssueToken
+)
+
+// IssueToken creates an HMAC-signed token valid for ttl, for AuthHMAC mode
+func IssueToken(secret string, ttl time.Duration) string {
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return expiry + "." + sign(secret, "auth:"+expiry)
+}
+
+// requestToken reads the bearer token from Authorization header or ?token= query
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (s *Server) authenticate(r *http.Request) error {
+	if s.opts.AuthMode == "" || s.opts.AuthMode == AuthNone {
+		return nil
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		return fmt.Errorf("missing token")
+	}
+
+	switch s.opts.AuthMode {
+	case AuthSecret:
+		if !hmac.Equal([]byte(token), []byte(s.opts.AuthSecret)) {
+			return fmt.Errorf("invalid token")
+		}
+		return nil
+
+	case AuthHMAC:
+		idx := strings.LastIndex(token, ".")
+		if idx <= 0 {
+			return fmt.Errorf("malformed token")
+		}
+		expiry := token[:idx]
+		if !hmac.Equal([]byte(token[idx+1:]), []byte(sign(s.opts.AuthSecret, "auth:"+expiry))) {
+			return fmt.Errorf("invalid token")
+		}
+		ts, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed token")
+		}
+		if time.Now().Unix() > ts {
+			return fmt.Errorf("token expired")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown auth mode %s", s.opts.AuthMode)
+}
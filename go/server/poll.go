@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"testrtc2/protocol"
+)
+
+const pollQueued = 256 // packets waiting for the next poll
+
+// vars so tests can shorten them
+var (
+	pollHold   = 25 * time.Second // hold a poll this long waiting for packets
+	pollExpiry = 40 * time.Second // drop a session not polled for this long
+	pollCheck  = time.Second      // how often expirePoll looks for idle sessions
+)
+
+// pollQueue keeps packets of a long-poll client until it polls them
+type pollQueue struct {
+	key      string
+	packets  chan []byte
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func newPollQueue() *pollQueue {
+	return &pollQueue{
+		key:      randomSecret(),
+		packets:  make(chan []byte, pollQueued),
+		done:     make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+}
+
+func (q *pollQueue) push(packet []byte) error {
+	select {
+	case q.packets <- packet:
+		return nil
+	default:
+		return fmt.Errorf("poll queue full")
+	}
+}
+
+func (q *pollQueue) close() {
+	q.once.Do(func() { close(q.done) })
+}
+
+func (q *pollQueue) touch() {
+	q.mu.Lock()
+	q.lastSeen = time.Now()
+	q.mu.Unlock()
+}
+
+func (q *pollQueue) idle() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Since(q.lastSeen)
+}
+
+// wait returns queued packets, waiting up to pollHold for the first one
+func (q *pollQueue) wait(r *http.Request) []json.RawMessage {
+	packets := []json.RawMessage{}
+
+	timer := time.NewTimer(pollHold)
+	defer timer.Stop()
+	select {
+	case packet := <-q.packets:
+		packets = append(packets, packet)
+	case <-timer.C:
+		return packets
+	case <-q.done:
+		return packets
+	case <-r.Context().Done():
+		return packets
+	}
+
+	for {
+		select {
+		case packet := <-q.packets:
+			packets = append(packets, packet)
+		default:
+			return packets
+		}
+	}
+}
+
+// servePoll serves long-poll clients
+//
+//	POST without session: open a session, replies {"session": key}
+//	GET ?session=key: wait for packets, replies a json array of packets
+//	POST ?session=key: send one packet, same as a websocket message
+//	DELETE ?session=key: leave
+func (s *Server) servePoll(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("session")
+	if key == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "websocket or long-poll only", http.StatusMethodNotAllowed)
+			return
+		}
+		s.openPoll(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	c := s.polls[key]
+	s.mu.Unlock()
+	if c == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c.poll.touch()
+		packets := c.poll.wait(r)
+		c.poll.touch()
+		writeJSON(w, packets)
+
+	case http.MethodPost:
+		c.poll.touch()
+		message, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.handleMessage(c, message)
+		if err != nil {
+			log.Printf("Client %s sent malformed packet: %s", c.id, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, struct{}{})
+
+	case http.MethodDelete:
+		c.close()
+		writeJSON(w, struct{}{})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) openPoll(w http.ResponseWriter, r *http.Request) {
+	if err := s.authenticate(r); err != nil {
+		log.Printf("Rejected %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, protocol.ErrorPacket{
+			ActionPacket: protocol.ActionPacket{Action: "error"},
+			Msg:          "Authentication failed: " + err.Error(),
+		})
+		return
+	}
+
+	c := &client{poll: newPollQueue()}
+	err := s.register(c, r)
+	if err != nil {
+		log.Printf("Client %s write init failed: %s", c.id, err)
+	}
+
+	s.mu.Lock()
+	s.polls[c.poll.key] = c
+	s.mu.Unlock()
+	go s.expirePoll(c)
+
+	writeJSON(w, protocol.PollSession{Session: c.poll.key})
+}
+
+// expirePoll removes the client once it leaves or stops polling
+func (s *Server) expirePoll(c *client) {
+	ticker := time.NewTicker(pollCheck)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-c.poll.done:
+			break loop
+		case <-ticker.C:
+			if c.poll.idle() > pollExpiry {
+				break loop
+			}
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.polls, c.poll.key)
+	s.mu.Unlock()
+	s.unregister(c)
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultResumeTTL is how long a resume token stays valid when Options.ResumeTTL is zero
+const DefaultResumeTTL = 24 * time.Hour
+
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func sign(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadResumeSecret reads the resume secret kept in path, creating a random one on first use
+// so user IDs stay valid across server restarts without passing a secret
+func LoadResumeSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	secret := randomSecret()
+	return secret, ioutil.WriteFile(path, []byte(secret+"\n"), 0600)
+}
+
+// resumeToken signs the user ID and an expiry, so a reconnecting client can claim the ID back
+// any server sharing the same secret accepts it until it expires, even after a restart
+// the nonce makes every token unique, to tell the last one given out from older ones
+func (s *Server) resumeToken(id string) string {
+	expiry := strconv.FormatInt(time.Now().Add(s.opts.ResumeTTL).Unix(), 10)
+	data := id + "." + expiry + "." + randomSecret()[:16]
+	return data + "." + sign(s.opts.ResumeSecret, "resume:"+data)
+}
+
+func (s *Server) parseResumeToken(token string) (id string, err error) {
+	idx := strings.LastIndex(token, ".")
+	if idx <= 0 {
+		return "", fmt.Errorf("malformed token")
+	}
+	data, mac := token[:idx], token[idx+1:]
+	if !hmac.Equal([]byte(mac), []byte(sign(s.opts.ResumeSecret, "resume:"+data))) {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	// id.expiry.nonce, the id may hold dots
+	fields := strings.Split(data, ".")
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	expiry := fields[len(fields)-2]
+	ts, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed token")
+	}
+	if time.Now().Unix() > ts {
+		return "", fmt.Errorf("token expired")
+	}
+	return strings.Join(fields[:len(fields)-2], "."), nil
+}
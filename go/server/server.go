@@ -0,0 +1,448 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"testrtc2/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server is a websocket signal server, a drop-in replacement for signal.py
+// Each connection gets an ID, and messages are forwarded between IDs
+// Clients without websocket can use HTTP long-poll on the same address
+type Server struct {
+	opts     Options
+	upgrader websocket.Upgrader
+	clients  map[string]*client
+	rooms    map[string]map[string]*client
+	polls    map[string]*client // by poll session key
+	epoch    string             // prefix of new IDs, so they never match an ID given out before a restart
+	count    int
+	mu       sync.Mutex // clients + rooms + polls mutex
+}
+
+type client struct {
+	id    string
+	room  string          // guarded by server mutex
+	token string          // resume token sent in init, guarded by server mutex
+	conn  *websocket.Conn // nil for long-poll client
+	poll  *pollQueue      // nil for websocket client
+	mu    sync.Mutex      // write mutex
+}
+
+// Options configures the signal server
+type Options struct {
+	// ResumeSecret signs resume tokens, random if empty
+	// set it to let clients keep their IDs across server restarts
+	ResumeSecret string
+	// ResumeTTL is how long a resume token stays valid, DefaultResumeTTL if zero
+	ResumeTTL time.Duration
+
+	// AuthMode is one of AuthNone, AuthSecret, AuthHMAC
+	AuthMode   string
+	AuthSecret string
+}
+
+func NewServer(opts Options) *Server {
+	if opts.ResumeSecret == "" {
+		opts.ResumeSecret = randomSecret()
+	}
+	if opts.ResumeTTL == 0 {
+		opts.ResumeTTL = DefaultResumeTTL
+	}
+
+	return &Server{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  65535,
+			WriteBufferSize: 65535,
+			// web client might be opened from file:// or any origin
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: make(map[string]*client),
+		rooms:   make(map[string]map[string]*client),
+		polls:   make(map[string]*client),
+		epoch:   strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 36),
+	}
+}
+
+func (c *client) sendPacket(obj interface{}) error {
+	packet, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	if c.poll != nil {
+		return c.poll.push(packet)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, packet)
+}
+
+func (c *client) close() {
+	if c.poll != nil {
+		c.poll.close()
+		return
+	}
+	c.conn.Close()
+}
+
+func (c *client) sendError(msg string) {
+	err := c.sendPacket(protocol.ErrorPacket{ActionPacket: protocol.ActionPacket{Action: "error"}, Msg: msg})
+	if err != nil {
+		log.Printf("Client %s write error failed: %s", c.id, err)
+	}
+}
+
+// addClient gives the new client an ID and a resume token, reusing resumeID when given
+// a client still holding that ID is taken over, keeping its room, only when token is
+// the one it was given, so an old token cannot steal a live session
+// returns false when resumeID was refused and a new ID given instead
+func (s *Server) addClient(c *client, resumeID, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.clients[resumeID]
+	resumed := resumeID != "" && (old == nil || old.token == token)
+	if resumed {
+		c.id = resumeID
+		if old != nil {
+			if old.room != "" {
+				c.room = old.room
+				s.rooms[old.room][c.id] = c
+				old.room = ""
+			}
+			old.close()
+		}
+	} else {
+		s.count++
+		c.id = s.epoch + "-" + strconv.Itoa(s.count)
+	}
+
+	c.token = s.resumeToken(c.id)
+	s.clients[c.id] = c
+	return resumed
+}
+
+func (s *Server) removeClient(c *client) {
+	s.leaveRoom(c)
+
+	s.mu.Lock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+	}
+	s.mu.Unlock()
+}
+
+// roomMembers returns the members of room except the given one, needs mutex held
+func (s *Server) roomMembers(room string, except *client) (members []*client) {
+	for _, m := range s.rooms[room] {
+		if m != except {
+			members = append(members, m)
+		}
+	}
+	return
+}
+
+func (s *Server) memberIDs(room string) []string {
+	ids := []string{}
+	for id := range s.rooms[room] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Server) broadcastPresence(members []*client, room, id, event string) {
+	packet := protocol.PresencePacket{
+		ActionPacket: protocol.ActionPacket{Action: "presence"},
+		Room:         room,
+		ID:           id,
+		Event:        event,
+	}
+	for _, m := range members {
+		if err := m.sendPacket(packet); err != nil {
+			log.Printf("Client %s write presence failed: %s", m.id, err)
+		}
+	}
+}
+
+func (s *Server) joinRoom(c *client, room string) {
+	s.mu.Lock()
+	if c.room == room {
+		// already there, e.g. rejoin after resume
+		ids := s.memberIDs(room)
+		s.mu.Unlock()
+		s.sendMembers(c, room, ids)
+		return
+	}
+	s.mu.Unlock()
+
+	s.leaveRoom(c)
+
+	s.mu.Lock()
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[string]*client)
+	}
+	s.rooms[room][c.id] = c
+	c.room = room
+	others := s.roomMembers(room, c)
+	ids := s.memberIDs(room)
+	s.mu.Unlock()
+
+	log.Printf("Client %s joined room %s", c.id, room)
+	s.broadcastPresence(others, room, c.id, "join")
+	s.sendMembers(c, room, ids)
+}
+
+func (s *Server) leaveRoom(c *client) {
+	s.mu.Lock()
+	room := c.room
+	if room == "" {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.rooms[room], c.id)
+	if len(s.rooms[room]) == 0 {
+		delete(s.rooms, room)
+	}
+	c.room = ""
+	others := s.roomMembers(room, nil)
+	s.mu.Unlock()
+
+	log.Printf("Client %s left room %s", c.id, room)
+	s.broadcastPresence(others, room, c.id, "leave")
+}
+
+func (s *Server) sendMembers(c *client, room string, ids []string) {
+	err := c.sendPacket(protocol.MembersPacket{
+		ActionPacket: protocol.ActionPacket{Action: "members"},
+		Room:         room,
+		Members:      ids,
+	})
+	if err != nil {
+		log.Printf("Client %s write members failed: %s", c.id, err)
+	}
+}
+
+func (s *Server) getClient(id string) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[id]
+}
+
+func (s *Server) handleSend(c *client, message []byte) error {
+	var sp protocol.SendPacket
+	err := json.Unmarshal(message, &sp)
+	if err != nil {
+		return err
+	}
+
+	if sp.Room != "" {
+		return s.handleBroadcast(c, sp)
+	}
+
+	peer := s.getClient(sp.To)
+	if peer == nil {
+		log.Printf("Client %s sent bad request", c.id)
+		c.sendError(fmt.Sprintf("Cannot find peer '%s'", sp.To))
+		return nil
+	}
+
+	err = peer.sendPacket(protocol.RecvPacket{ActionPacket: protocol.ActionPacket{Action: "recv"}, From: c.id, Msg: sp.Msg})
+	if err != nil {
+		log.Printf("Client %s write failed: %s", peer.id, err)
+	}
+	return nil
+}
+
+func (s *Server) handleBroadcast(c *client, sp protocol.SendPacket) error {
+	s.mu.Lock()
+	inRoom := c.room == sp.Room
+	others := s.roomMembers(sp.Room, c)
+	s.mu.Unlock()
+
+	if !inRoom {
+		log.Printf("Client %s sent to room %s without joining", c.id, sp.Room)
+		c.sendError(fmt.Sprintf("Not in room '%s'", sp.Room))
+		return nil
+	}
+
+	packet := protocol.RecvPacket{ActionPacket: protocol.ActionPacket{Action: "recv"}, From: c.id, Room: sp.Room, Msg: sp.Msg}
+	for _, m := range others {
+		if err := m.sendPacket(packet); err != nil {
+			log.Printf("Client %s write failed: %s", m.id, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleMessage(c *client, message []byte) error {
+	var ap protocol.ActionPacket
+	err := json.Unmarshal(message, &ap)
+	if err != nil {
+		return err
+	}
+
+	switch ap.Action {
+	case "send":
+		return s.handleSend(c, message)
+
+	case "join":
+		var jp protocol.JoinPacket
+		err = json.Unmarshal(message, &jp)
+		if err != nil {
+			return err
+		}
+		if jp.Room == "" {
+			c.sendError("Room name is empty")
+			return nil
+		}
+		s.joinRoom(c, jp.Room)
+
+	case "leave":
+		s.leaveRoom(c)
+
+	case "members":
+		s.mu.Lock()
+		room := c.room
+		ids := s.memberIDs(room)
+		s.mu.Unlock()
+		if room == "" {
+			c.sendError("Not in any room")
+			return nil
+		}
+		s.sendMembers(c, room, ids)
+
+	default:
+		log.Printf("Client %s unsupported action: %s", c.id, ap.Action)
+		c.sendError(fmt.Sprintf("Unsupported action '%s'", ap.Action))
+	}
+	return nil
+}
+
+// ServeHTTP serves websocket upgrades, and HTTP long-poll for other requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocket(w, r)
+	} else {
+		s.servePoll(w, r)
+	}
+}
+
+// register gives the client its ID and sends the init packet
+func (s *Server) register(c *client, r *http.Request) error {
+	resumeID := ""
+	token := r.URL.Query().Get("resume")
+	if token != "" {
+		id, err := s.parseResumeToken(token)
+		if err == nil {
+			resumeID = id
+		} else {
+			log.Printf("Resume token from %s refused: %s", r.RemoteAddr, err)
+		}
+	}
+
+	if s.addClient(c, resumeID, token) {
+		log.Printf("Resumed user: %s", c.id)
+	} else if resumeID != "" {
+		log.Printf("New user: %s, %s is still connected with another token", c.id, resumeID)
+	} else {
+		log.Printf("New user: %s", c.id)
+	}
+
+	return c.sendPacket(protocol.InitPacket{
+		ActionPacket: protocol.ActionPacket{Action: "init"},
+		ID:           c.id,
+		Token:        c.token,
+	})
+}
+
+func (s *Server) unregister(c *client) {
+	s.removeClient(c)
+	log.Printf("Client %s disconnected", c.id)
+}
+
+// serveWebSocket serves the client until it leaves
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Upgrade failed: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := s.authenticate(r); err != nil {
+		log.Printf("Rejected %s: %s", r.RemoteAddr, err)
+		reject := &client{id: "-", conn: conn}
+		reject.sendError("Authentication failed: " + err.Error())
+		// policy violation tells the client not to reconnect
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed"),
+			time.Now().Add(time.Second))
+		return
+	}
+
+	c := &client{conn: conn}
+	err = s.register(c, r)
+	defer s.unregister(c)
+	if err != nil {
+		log.Printf("Client %s write init failed: %s", c.id, err)
+		return
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		err = s.handleMessage(c, message)
+		if err != nil {
+			log.Printf("Client %s sent malformed packet: %s", c.id, err)
+		}
+	}
+}
+
+// ListenAndServe runs the signal server on addr, serving websocket on any path
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("Server is running at %s", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+// ListenAndServeTLS is ListenAndServe over TLS for wss:// clients
+// when clientCAFile is set, clients must present a certificate signed by it
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile, clientCAFile string) error {
+	sv := &http.Server{Addr: addr, Handler: s}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		sv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	log.Printf("Server is running at %s (TLS)", addr)
+	return sv.ListenAndServeTLS(certFile, keyFile)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"testrtc2/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	pollHold = 2 * time.Second
+	pollExpiry = 300 * time.Millisecond
+	pollCheck = 50 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+type testClient struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	id    string
+	token string
+}
+
+// dialRaw connects to ts with the given query, without reading init
+func dialRaw(t *testing.T, ts *httptest.Server, query url.Values) *websocket.Conn {
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/?" + query.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+// dial connects to ts and reads the init packet
+func dial(t *testing.T, ts *httptest.Server, query url.Values) *testClient {
+	c := &testClient{t: t, conn: dialRaw(t, ts, query)}
+	var ip protocol.InitPacket
+	c.read(&ip)
+	if ip.Action != "init" || ip.ID == "" || ip.Token == "" {
+		t.Fatalf("init: got %+v", ip)
+	}
+	c.id, c.token = ip.ID, ip.Token
+	return c
+}
+
+func (c *testClient) send(obj interface{}) {
+	if err := c.conn.WriteJSON(obj); err != nil {
+		c.t.Fatalf("%s write: %v", c.id, err)
+	}
+}
+
+func (c *testClient) read(obj interface{}) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := c.conn.ReadJSON(obj); err != nil {
+		c.t.Fatalf("%s read: %v", c.id, err)
+	}
+}
+
+func (c *testClient) join(room string) protocol.MembersPacket {
+	c.send(protocol.JoinPacket{ActionPacket: protocol.ActionPacket{Action: "join"}, Room: room})
+	var mp protocol.MembersPacket
+	c.read(&mp)
+	return mp
+}
+
+func (c *testClient) readPresence(room, id, event string) {
+	var pp protocol.PresencePacket
+	c.read(&pp)
+	want := protocol.PresencePacket{ActionPacket: protocol.ActionPacket{Action: "presence"}, Room: room, ID: id, Event: event}
+	if pp != want {
+		c.t.Errorf("%s presence: got %+v, want %+v", c.id, pp, want)
+	}
+}
+
+func (c *testClient) readRecv(from, room, body string) {
+	var rp protocol.RecvPacket
+	c.read(&rp)
+	if rp.Action != "recv" || rp.From != from || rp.Room != room || rp.Msg.Body != body {
+		c.t.Errorf("%s recv: got %+v, want from %s room %q body %s", c.id, rp, from, room, body)
+	}
+}
+
+func (c *testClient) readError(msg string) {
+	var ep protocol.ErrorPacket
+	c.read(&ep)
+	if ep.Action != "error" || ep.Msg != msg {
+		c.t.Errorf("%s error: got %+v, want %q", c.id, ep, msg)
+	}
+}
+
+func sendPacket(to, room, body string) protocol.SendPacket {
+	return protocol.SendPacket{
+		ActionPacket: protocol.ActionPacket{Action: "send"},
+		To:           to,
+		Room:         room,
+		Msg:          protocol.Message{Topic: "test", Body: body},
+	}
+}
+
+func TestRoom(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{}))
+	defer ts.Close()
+	a := dial(t, ts, nil)
+	b := dial(t, ts, nil)
+	c := dial(t, ts, nil)
+	if a.id == b.id || b.id == c.id {
+		t.Fatalf("IDs not unique: %s %s %s", a.id, b.id, c.id)
+	}
+
+	if mp := a.join("r"); !reflect.DeepEqual(mp.Members, []string{a.id}) {
+		t.Errorf("a join: got %+v", mp)
+	}
+	mp := b.join("r")
+	a.readPresence("r", b.id, "join")
+	if len(mp.Members) != 2 {
+		t.Errorf("b join: got %+v", mp)
+	}
+
+	b.send(sendPacket("", "r", "hello room"))
+	a.readRecv(b.id, "r", "hello room")
+
+	c.send(sendPacket("", "r", "not joined"))
+	c.readError("Not in room 'r'")
+
+	c.send(sendPacket(a.id, "", "direct"))
+	a.readRecv(c.id, "", "direct")
+
+	c.send(sendPacket("nobody", "", "lost"))
+	c.readError("Cannot find peer 'nobody'")
+
+	b.send(protocol.ActionPacket{Action: "leave"})
+	a.readPresence("r", b.id, "leave")
+
+	b.conn.Close()
+	a.send(protocol.ActionPacket{Action: "members"})
+	var members protocol.MembersPacket
+	a.read(&members)
+	if !reflect.DeepEqual(members.Members, []string{a.id}) {
+		t.Errorf("members: got %+v", members)
+	}
+}
+
+func TestResume(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{ResumeSecret: "s"}))
+	defer ts.Close()
+	a := dial(t, ts, nil)
+	b := dial(t, ts, nil)
+	a.join("r")
+	b.join("r")
+	a.readPresence("r", b.id, "join")
+
+	// a dropped, but the server still holds its connection: the new one takes over
+	a2 := dial(t, ts, url.Values{"resume": {a.token}})
+	if a2.id != a.id {
+		t.Fatalf("resume: got ID %s, want %s", a2.id, a.id)
+	}
+	a2.send(protocol.ActionPacket{Action: "members"})
+	var mp protocol.MembersPacket
+	a2.read(&mp)
+	if mp.Room != "r" || len(mp.Members) != 2 {
+		t.Errorf("resumed members: got %+v", mp)
+	}
+	a.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := a.conn.ReadMessage(); err == nil {
+		t.Errorf("taken over connection still open")
+	}
+
+	// the old token cannot take the live session over
+	a3 := dial(t, ts, url.Values{"resume": {a.token}})
+	if a3.id == a.id {
+		t.Fatalf("stale token took over %s", a.id)
+	}
+	b.send(sendPacket(a.id, "", "still there"))
+	a2.readRecv(b.id, "", "still there")
+
+	// after a restart with the same secret, the ID is back and new IDs differ
+	time.Sleep(2 * time.Millisecond)
+	ts2 := httptest.NewServer(NewServer(Options{ResumeSecret: "s"}))
+	defer ts2.Close()
+	a4 := dial(t, ts2, url.Values{"resume": {a2.token}})
+	if a4.id != a.id {
+		t.Errorf("resume after restart: got ID %s, want %s", a4.id, a.id)
+	}
+	if n := dial(t, ts2, nil); n.id == a.id || n.id == b.id {
+		t.Errorf("new ID %s collides with an ID given out before the restart", n.id)
+	}
+
+	// another secret refuses the token
+	ts3 := httptest.NewServer(NewServer(Options{ResumeSecret: "other"}))
+	defer ts3.Close()
+	if a5 := dial(t, ts3, url.Values{"resume": {a2.token}}); a5.id == a.id {
+		t.Errorf("resume with a token of another secret kept ID %s", a.id)
+	}
+}
+
+func TestResumeExpired(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{ResumeTTL: -time.Second}))
+	defer ts.Close()
+	a := dial(t, ts, nil)
+	a.conn.Close()
+	if a2 := dial(t, ts, url.Values{"resume": {a.token}}); a2.id == a.id {
+		t.Errorf("expired token kept ID %s", a.id)
+	}
+}
+
+// dialRejected expects an error packet then a policy violation close
+func dialRejected(t *testing.T, ts *httptest.Server, query url.Values, msg string) {
+	c := &testClient{t: t, conn: dialRaw(t, ts, query)}
+	c.readError("Authentication failed: " + msg)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := c.conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("%s: got %v, want close %d", msg, err, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{AuthMode: AuthHMAC, AuthSecret: "s"}))
+	defer ts.Close()
+	dial(t, ts, url.Values{"token": {IssueToken("s", time.Hour)}})
+	dialRejected(t, ts, nil, "missing token")
+	dialRejected(t, ts, url.Values{"token": {IssueToken("other", time.Hour)}}, "invalid token")
+	dialRejected(t, ts, url.Values{"token": {IssueToken("s", -time.Minute)}}, "token expired")
+
+	resp, err := http.Post(ts.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("long-poll without token: got %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	ts = httptest.NewServer(NewServer(Options{AuthMode: AuthSecret, AuthSecret: "s"}))
+	defer ts.Close()
+	dial(t, ts, url.Values{"token": {"s"}})
+	dialRejected(t, ts, url.Values{"token": {"x"}}, "invalid token")
+}
+
+// poll does one long-poll request, decoding the reply into obj
+func poll(t *testing.T, method, u string, body interface{}, obj interface{}) int {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, u, strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, u, err)
+	}
+	defer resp.Body.Close()
+	if obj != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+			t.Fatalf("%s %s: %v", method, u, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestPoll(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{}))
+	defer ts.Close()
+	var session protocol.PollSession
+	if code := poll(t, http.MethodPost, ts.URL, nil, &session); code != http.StatusOK || session.Session == "" {
+		t.Fatalf("open: got %d %+v", code, session)
+	}
+	u := ts.URL + "/?session=" + session.Session
+
+	var packets []json.RawMessage
+	poll(t, http.MethodGet, u, nil, &packets)
+	var ip protocol.InitPacket
+	if len(packets) != 1 || json.Unmarshal(packets[0], &ip) != nil || ip.Action != "init" {
+		t.Fatalf("init: got %s", packets)
+	}
+
+	poll(t, http.MethodPost, u, protocol.JoinPacket{ActionPacket: protocol.ActionPacket{Action: "join"}, Room: "r"}, nil)
+	b := dial(t, ts, nil)
+	b.join("r")
+	b.send(sendPacket(ip.ID, "", "to poll"))
+
+	// members, presence of b and the message, maybe over several polls
+	var got []string
+	for i := 0; len(got) < 3 && i < 5; i++ {
+		packets = nil
+		poll(t, http.MethodGet, u, nil, &packets)
+		for _, p := range packets {
+			var ap protocol.ActionPacket
+			json.Unmarshal(p, &ap)
+			got = append(got, ap.Action)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"members", "presence", "recv"}) {
+		t.Errorf("polled: got %v", got)
+	}
+
+	poll(t, http.MethodPost, u, sendPacket(b.id, "", "from poll"), nil)
+	b.readRecv(ip.ID, "", "from poll")
+
+	poll(t, http.MethodDelete, u, nil, nil)
+	b.readPresence("r", ip.ID, "leave")
+	if code := poll(t, http.MethodGet, u, nil, nil); code != http.StatusNotFound {
+		t.Errorf("after delete: got %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestPollExpiry(t *testing.T) {
+	ts := httptest.NewServer(NewServer(Options{}))
+	defer ts.Close()
+	b := dial(t, ts, nil)
+	b.join("r")
+
+	var session protocol.PollSession
+	poll(t, http.MethodPost, ts.URL, nil, &session)
+	u := ts.URL + "/?session=" + session.Session
+	poll(t, http.MethodPost, u, protocol.JoinPacket{ActionPacket: protocol.ActionPacket{Action: "join"}, Room: "r"}, nil)
+	var pp protocol.PresencePacket
+	b.read(&pp)
+
+	// not polled for pollExpiry, the session is dropped and leaves the room
+	var leave protocol.PresencePacket
+	b.read(&leave)
+	if leave.Event != "leave" || leave.ID != pp.ID {
+		t.Errorf("expiry: got %+v", leave)
+	}
+	if code := poll(t, http.MethodGet, u, nil, nil); code != http.StatusNotFound {
+		t.Errorf("after expiry: got %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"testrtc2/network"
+)
+
+// settingsFlags are the flags of pion SettingEngine options and codecs
+type settingsFlags struct {
+	udpPorts     *string
+	natIPs       *string
+	natType      *string
+	networkTypes *string
+	disconnected *time.Duration
+	keepalive    *time.Duration
+	selection    *time.Duration
+	wait         *string
+	codecs       *string
+}
+
+func registerSettingsFlags() *settingsFlags {
+	defaults := network.DefaultSettings()
+	selection := flag.Duration("ice-selection", defaults.SelectionTimeout, "candidate selection timeout, ICE goes failed after it without a valid pair")
+	// pion has no failed timeout, like /config timeout failed
+	flag.DurationVar(selection, "ice-failed", defaults.SelectionTimeout, "alias of -ice-selection")
+	return &settingsFlags{
+		udpPorts:     flag.String("udp-ports", "", "ephemeral UDP port range of ICE, e.g. 50000-50100 (default any)"),
+		natIPs:       flag.String("nat-ips", "", "external IPs of a 1:1 NAT, comma separated"),
+		natType:      flag.String("nat-type", "host", "candidate type of -nat-ips: host replaces local IPs, srflx adds a candidate"),
+		networkTypes: flag.String("network-types", "", "ICE network types, comma separated: udp4, udp6 (default all)"),
+		disconnected: flag.Duration("ice-disconnected", defaults.DisconnectedTimeout, "silence on the selected pair before ICE goes disconnected"),
+		keepalive:    flag.Duration("ice-keepalive", defaults.KeepaliveInterval, "ICE keepalive interval"),
+		selection:    selection,
+		wait:         flag.String("ice-wait", "", "acceptance min wait per candidate type, e.g. host=0s,relay=5s"),
+		codecs:       flag.String("codecs", "", "codecs in order of preference with optional fmtp, e.g. h264:profile-level-id=42e01f;packetization-mode=1,pcmu (kinds not listed keep pion defaults)"),
+	}
+}
+
+func (f *settingsFlags) settings() (network.Settings, error) {
+	settings := network.DefaultSettings()
+	var err error
+
+	settings.PortMin, settings.PortMax, err = network.ParsePortRange(*f.udpPorts)
+	if err != nil {
+		return settings, err
+	}
+	if *f.natIPs != "" {
+		settings.NAT1To1IPs, err = network.ParseNATIPs(*f.natIPs)
+		if err != nil {
+			return settings, err
+		}
+	}
+	settings.NAT1To1Type, err = network.ParseNATType(*f.natType)
+	if err != nil {
+		return settings, err
+	}
+	settings.NetworkTypes, err = network.ParseNetworkTypes(*f.networkTypes)
+	if err != nil {
+		return settings, err
+	}
+
+	settings.Codecs, err = network.ParseCodecs(*f.codecs)
+	if err != nil {
+		return settings, err
+	}
+
+	timeouts := map[string]time.Duration{
+		"disconnected": *f.disconnected,
+		"keepalive":    *f.keepalive,
+		"selection":    *f.selection,
+	}
+	for name, d := range timeouts {
+		err = settings.SetTimeout(name, d)
+		if err != nil {
+			return settings, err
+		}
+	}
+
+	if *f.wait == "" {
+		return settings, nil
+	}
+	for _, rule := range strings.Split(*f.wait, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 {
+			return settings, fmt.Errorf("bad -ice-wait %s, need type=duration", rule)
+		}
+		d, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return settings, err
+		}
+		err = settings.SetWait(kv[0], d)
+		if err != nil {
+			return settings, err
+		}
+	}
+	return settings, nil
+}